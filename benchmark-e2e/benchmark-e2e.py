@@ -1,263 +1,3306 @@
 #!/usr/bin/env python3
 import argparse
+import codecs
+import contextlib
+import csv
+import dataclasses
+import datetime
+import difflib
+import fcntl
+import glob
+import hashlib
+import itertools
+import json
 import logging
 import os
+import re
+import shlex
 import shutil
 import signal
+import socket
+import statistics
 import subprocess
 import sys
+import tempfile
+import threading
 import time
+import warnings
 from pathlib import Path
 
 import requests
 
 
-def parse_args():
+# load generators the benchmark script can drive; only vllm writes results.json
+BENCH_CLIENTS = ["vllm", "guidellm"]
+
+# metric name -> (results.json key, unit, higher is better)
+COMPARE_METRICS = {
+    "throughput": ("output_throughput", "tok/s", True),
+    "ttft": ("median_ttft_ms", "ms", False),
+    "tpot": ("median_tpot_ms", "ms", False),
+    "p99_latency": ("p99_e2el_ms", "ms", False),
+}
+
+
+LABEL_RE = re.compile(r"^[A-Za-z0-9_.-]+=[^\s'\"]+$")
+
+
+CUDA_UUID_RE = re.compile(r"^(GPU|MIG)-[0-9A-Za-z/-]+$")
+
+
+def parse_cuda_devices(s):
+    """Normalize a CUDA_VISIBLE_DEVICES value made of indices and/or GPU-/MIG- UUIDs."""
+    if not s.strip():
+        return ""
+    devices = []
+    for d in s.split(","):
+        d = d.strip()
+        # isdigit alone also accepts non-ASCII digits such as "²", which int() rejects
+        if d.isascii() and d.isdigit():
+            devices.append(str(int(d)))
+        elif CUDA_UUID_RE.match(d):
+            devices.append(d)
+        else:
+            raise argparse.ArgumentTypeError(
+                f"invalid CUDA device {d!r} in {s!r}; expected indices (0,1) or GPU-/MIG- UUIDs")
+    if len(set(devices)) != len(devices):
+        raise argparse.ArgumentTypeError(f"duplicate CUDA device in {s!r}")
+    return ",".join(devices)
+
+
+def cuda_device_count(devices):
+    return len(devices.split(",")) if devices else 0
+
+
+HEADER_RE = re.compile(r"^([!#$%&'*+.^_`|~0-9A-Za-z-]+):[ \t]*([^\r\n]*)$")
+
+
+def parse_header(s):
+    m = HEADER_RE.match(s)
+    if not m or not m.group(2).strip():
+        raise argparse.ArgumentTypeError(f"invalid header {s!r}, expected 'Name: Value'")
+    return m.group(1), m.group(2).strip()
+
+
+def parse_label(s):
+    if not LABEL_RE.match(s):
+        raise argparse.ArgumentTypeError(f"invalid label {s!r}, expected key=value without spaces or quotes")
+    if s.split("=", 1)[0] == "framework":
+        raise argparse.ArgumentTypeError("label key 'framework' is reserved")
+    return s
+
+
+def parse_fraction_list(s):
+    try:
+        vals = [float(v) for v in s.split(",") if v.strip()]
+    except ValueError:
+        raise argparse.ArgumentTypeError(f"invalid fraction list {s!r}")
+    for v in vals:
+        if not 0 < v <= 1:
+            raise argparse.ArgumentTypeError(f"fraction {v:g} must be in (0, 1]")
+    return vals
+
+
+def parse_int_list(s):
+    try:
+        vals = [int(v) for v in s.split(",") if v.strip()]
+    except ValueError:
+        raise argparse.ArgumentTypeError(f"invalid integer list {s!r}")
+    for v in vals:
+        if v <= 0:
+            raise argparse.ArgumentTypeError(f"{v} must be a positive integer")
+    return vals
+
+
+DURATION_RE = re.compile(r"(\d+(?:\.\d+)?)(h|ms|m|s)")
+DURATION_UNITS = {"h": 3600, "m": 60, "s": 1, "ms": 0.001}
+
+
+def parse_duration(s):
+    """Seconds from a plain number or a duration like 90s, 10m or 1h30m."""
+    s = s.strip()
+    try:
+        secs = float(s)
+    except ValueError:
+        parts = DURATION_RE.findall(s)
+        if not parts or "".join(n + u for n, u in parts) != s:
+            raise argparse.ArgumentTypeError(f"invalid duration {s!r} (e.g. 90, 90s, 10m, 1h30m)")
+        secs = sum(float(n) * DURATION_UNITS[u] for n, u in parts)
+    if secs <= 0:
+        raise argparse.ArgumentTypeError(f"duration {s!r} must be positive")
+    return secs
+
+
+HOST_RE = re.compile(r"^[A-Za-z0-9_.@:-]+$")
+
+
+def parse_host(s):
+    s = s.strip()
+    if not HOST_RE.match(s):
+        raise argparse.ArgumentTypeError(f"invalid host {s!r}")
+    return s
+
+
+def parse_nodes(s):
+    hosts = [h.strip() for h in s.split(",") if h.strip()]
+    for h in hosts:
+        if not HOST_RE.match(h):
+            raise argparse.ArgumentTypeError(f"invalid host {h!r}")
+    if len(hosts) < 2:
+        raise argparse.ArgumentTypeError("--nodes needs the head node and at least one worker")
+    if len(set(hosts)) != len(hosts):
+        raise argparse.ArgumentTypeError(f"duplicate host in {s!r}")
+    return hosts
+
+
+VLLM_DEFAULT_VERSION = "0.8.3"
+VLLM_NIGHTLY_INDEX = "https://wheels.vllm.ai/nightly"
+SGLANG_DEFAULT_VERSION = "0.4.4.post1"
+TGI_DEFAULT_VERSION = "3.2.1"
+UV_INSTALLER = "https://astral.sh/uv/install.sh"
+LLAMACPP_REPO = "https://github.com/ggml-org/llama.cpp.git"
+LLAMACPP_DEFAULT_REF = "b5200"
+TGI_IMAGE = "ghcr.io/huggingface/text-generation-inference"
+FLASHINFER_DEFAULT_INDEX = "https://flashinfer.ai/whl/cu124/torch2.5/flashinfer-python"
+# package versions and index URLs are interpolated into bash -c install commands
+VERSION_RE = re.compile(r"^[A-Za-z0-9_.+!-]+$")
+INDEX_URL_RE = re.compile(r"^https?://[A-Za-z0-9_.~:/%+=-]+$")
+
+
+def parse_shell_args(s):
+    """Split extra server flags with shell quoting rules, e.g. "--max-model-len 8192 --chat-template 'a b'"."""
+    try:
+        return shlex.split(s)
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"invalid arguments {s!r}: {e}")
+
+
+def parse_version(s):
+    s = s.strip()
+    if s and not VERSION_RE.match(s):
+        raise argparse.ArgumentTypeError(f"invalid version {s!r}")
+    return s
+
+
+def parse_index_url(s):
+    s = s.strip()
+    if s and not INDEX_URL_RE.match(s):
+        raise argparse.ArgumentTypeError(f"invalid index URL {s!r}")
+    return s
+
+
+# generic script: every length and client setting comes from the environment (see BaseJob.bench_params)
+DEFAULT_BENCH_SCRIPT = "benchmark_1000_in_100_out.sh"
+DEFAULT_MODEL = "meta-llama/Llama-3.1-8B-Instruct"
+
+
+def parse_csv_list(s):
+    return [m.strip() for m in s.split(",") if m.strip()]
+
+
+SHA256_RE = re.compile(r"^[0-9a-f]{64}$")
+GIT_REF_RE = re.compile(r"^[A-Za-z0-9_][A-Za-z0-9_./+-]*$")
+
+
+def parse_git_ref(s):
+    # a leading "-" would be taken as a git option
+    if s and (not GIT_REF_RE.match(s) or ".." in s):
+        raise argparse.ArgumentTypeError(f"invalid git ref {s!r}")
+    return s
+
+
+def parse_sha256(s):
+    s = s.strip().lower()
+    if s and not SHA256_RE.match(s):
+        raise argparse.ArgumentTypeError(f"invalid SHA-256 digest {s!r} (expected 64 hex characters)")
+    return s
+
+
+def commit_label(commit):
+    """Framework label of a vllm source commit: a SHA shortened to 12 characters, any other ref in full."""
+    if re.fullmatch(r"[0-9a-f]{12,40}", commit):
+        return "vllm-" + commit[:12]
+    return "vllm-" + commit.replace("/", "-")
+
+
+def parse_args(argv=None, env=None):
+    """Parse argv (default sys.argv[1:]); env (default os.environ) supplies the env var defaults.
+
+    A flag always beats its env var, and the env var beats the built-in default.
+    """
+    env = os.environ if env is None else env
     p = argparse.ArgumentParser(description="Run vLLM & SGLang benchmarks")
-    p.add_argument("--port", type=int, default=8080, help="Port for both servers")
-    p.add_argument("--model", default="meta-llama/Llama-3.1-8B-Instruct", help="Model identifier")
-    p.add_argument("--cuda-device", default=os.getenv("CUDA_VISIBLE_DEVICES", ""), help="CUDA_VISIBLE_DEVICES override")
-    p.add_argument("--async", action="store_true", help="(ignored)")
-    return p.parse_args()
+    p.add_argument("--port", type=int, default=8080,
+                   help="Port for the servers (with --async, the base: job i listens on port+i)")
+    p.add_argument("--ports", type=parse_int_list, default=[],
+                   help="Comma-separated port per job, in job order, instead of --port")
+    p.add_argument("--model", dest="models", action="append", default=[],
+                   help=f"Model identifier (repeatable; default {DEFAULT_MODEL})")
+    p.add_argument("--models", dest="models_csv", type=parse_csv_list, default=[],
+                   help="Comma-separated model identifiers; every framework is benchmarked on each")
+    p.add_argument("--cuda-device", type=parse_cuda_devices, default=env.get("CUDA_VISIBLE_DEVICES", ""),
+                   help="CUDA_VISIBLE_DEVICES override (indices or GPU UUIDs)")
+    p.add_argument("--tp", dest="tensor_parallel", type=int, default=1,
+                   help="Tensor-parallel size of every server; should match the number of CUDA devices")
+    p.add_argument("--async", dest="run_async", action="store_true",
+                   help="Run all jobs concurrently, each server on its own port (they share the GPUs)")
+    p.add_argument("--bench-script", default=None,
+                   help="Scenario script in benchmark-compare to run (default benchmark_<in>_in_<out>_out.sh "
+                        f"for the input/output lengths if present, else the parameterized {DEFAULT_BENCH_SCRIPT})")
+    p.add_argument("--client", choices=BENCH_CLIENTS, default="vllm",
+                   help="Load generator the benchmark script uses, identical for every framework")
+    p.add_argument("--stream", choices=["true", "false"], default="true",
+                   help="Stream responses (true) or wait for complete responses (false)")
+    p.add_argument("--request-timeout", type=float, default=None,
+                   help="Per-request timeout in seconds for the benchmark client")
+    p.add_argument("--timeout-scale", type=float, default=1.0,
+                   help="Multiply the per-step timeouts (readiness and its polls, warmup, client requests) by this "
+                        "factor; --timeout and --job-timeout are budgets and are not scaled")
+    p.add_argument("--input-len", type=int, default=None,
+                   help="Random prompt input length (default from benchmark-config.json)")
+    p.add_argument("--output-len", type=int, default=None,
+                   help="Random prompt output length (default from benchmark-config.json)")
+    p.add_argument("--num-prompts", type=int, default=None,
+                   help="Prompts sent in the infinite-QPS run (default from benchmark-config.json)")
+    p.add_argument("--temperature", type=float, default=None, help="Sampling temperature of every request")
+    p.add_argument("--top-p", type=float, default=None, help="Nucleus sampling top_p of every request")
+    p.add_argument("--max-tokens", type=int, default=None,
+                   help="max_tokens of every request (the generated output length)")
+    p.add_argument("--freeze-prompts", nargs="?", const="", default=None, metavar="PATH",
+                   help="Benchmark every framework on one seeded prompt set saved in the log dir, "
+                        "or reuse/create the set at PATH across runs (vllm client only)")
+    p.add_argument("--ready-timeout", type=parse_duration, default=env.get("READY_TIMEOUT") or "120s",
+                   help="How long a server may take to become ready, e.g. 600, 10m (env READY_TIMEOUT, default 120s)")
+    p.add_argument("--server-host", type=parse_host, default="localhost",
+                   help="Host the readiness checks, warmup and benchmark client reach each server at "
+                        "(default localhost)")
+    p.add_argument("--server-scheme", choices=["http", "https"], default="http",
+                   help="Scheme of the servers' API, https when they terminate TLS (default http)")
+    p.add_argument("--insecure-skip-verify", action="store_true",
+                   help="Skip certificate checks of this script's own requests (readiness, warmup, metrics) to "
+                        "https servers; the benchmark client still verifies them, so this needs SSL_CERT_FILE")
+    p.add_argument("--poll-interval", type=parse_duration, default="2s",
+                   help="How often to poll a loading server for readiness, e.g. 500ms or 10s (default 2s); "
+                        "each poll's requests time out after at most half of it")
+    p.add_argument("--post-ready-delay", type=float, default=0,
+                   help="Seconds to wait after a server reports ready before warmup/benchmarking")
+    warmup = p.add_mutually_exclusive_group()
+    warmup.add_argument("--warmup-requests", type=int, default=0,
+                        help="Warmup requests sent to each server before benchmarking")
+    warmup.add_argument("--warmup-duration", type=float, default=0,
+                        help="Seconds of warmup traffic sent to each server before benchmarking")
+    p.add_argument("--header", dest="headers", type=parse_header, action="append", default=[],
+                   help="'Name: Value' HTTP header sent on every probe, warmup and benchmark request (repeatable)")
+    p.add_argument("--hf-token", default=env.get("HF_TOKEN") or env.get("HUGGING_FACE_HUB_TOKEN", ""),
+                   help="Hugging Face token for gated models, passed to servers and the benchmark client "
+                        "(env HF_TOKEN or HUGGING_FACE_HUB_TOKEN)")
+    p.add_argument("--label", dest="labels", type=parse_label, action="append", default=[],
+                   help="key=value label recorded in results metadata (repeatable)")
+    p.add_argument("--gpu-memory-utilization", type=parse_fraction_list, default=[],
+                   help="GPU memory fraction for the server; comma-separated values sweep, e.g. 0.8,0.9")
+    p.add_argument("--profile-startup", action="store_true",
+                   help="Time importing each framework in its venv, separately from server load")
+    p.add_argument("--abort-on-gpu-ecc-error", action="store_true",
+                   help="Refuse to run on GPUs with uncorrected ECC errors, and flag results if new ones appear")
+    p.add_argument("--work-dir", default="",
+                   help="Directory for clones, venvs and logs, created if missing (default: the current directory)")
+    p.add_argument("--log-dir", default="logs",
+                   help="Directory for server, benchmark and status logs, relative to the work dir")
+    p.add_argument("--export-startup-logs", action="store_true",
+                   help="Copy each server's output from launch until ready into <log dir>/<job>-startup.log")
+    p.add_argument("--preload-weights", action="store_true",
+                   help="Download model weights to the HF cache before any server starts")
+    p.add_argument("--min-throughput", type=float, default=None,
+                   help="Fail a framework whose peak output throughput (tok/s) is below this")
+    p.add_argument("--max-ttft", type=float, default=None,
+                   help="Fail a framework whose best median TTFT (ms) is above this")
+    p.add_argument("--ramp-window", type=float, default=None, metavar="SECONDS",
+                   help="Sample server-side generation throughput in windows of this length to record ramp-up")
+    p.add_argument("--debug-requests", action="store_true",
+                   help="Send one benchmark-like request per job and save it and the response to "
+                        "<log dir>/sample-<job>.json")
+    p.add_argument("--compare-output-correctness", action="store_true",
+                   help="Send fixed greedy prompts to each server and flag degenerate or divergent output")
+    p.add_argument("--nodes", type=parse_nodes, default=[],
+                   help="Comma-separated hosts to serve across; the first is this machine (the head), "
+                        "the rest are started over SSH and must have the same venvs at the same path")
+    p.add_argument("--measure-energy", action="store_true",
+                   help="Sample GPU power draw during each benchmark and report energy per million tokens")
+    p.add_argument("--gpu-sample-interval", type=float, default=1.0, metavar="SECONDS",
+                   help="Poll GPU memory this often during each benchmark to record its peak (0 disables)")
+    p.add_argument("--repeat", type=int, default=1,
+                   help="Run the benchmark script this many times against each server and report mean and stddev")
+    p.add_argument("--job-retries", type=int, default=0,
+                   help="Re-run a whole job up to this many times after transient CUDA/NCCL failures")
+    p.add_argument("--timeout", type=parse_duration, default=None,
+                   help="Abort the whole run (installs, servers, benchmarks) after this long, e.g. 3h; "
+                        "not scaled by --timeout-scale")
+    p.add_argument("--job-timeout", type=parse_duration, default=None,
+                   help="Fail a single job (install, serving, benchmarks and retries) after this long "
+                        "and kill its server, e.g. 45m; not scaled by --timeout-scale")
+    p.add_argument("--log-format", choices=["text", "json"], default="text",
+                   help="Orchestrator log lines as plain text or JSON objects (server output stays as-is)")
+    p.add_argument("--events", default="", metavar="PATH",
+                   help="Append lifecycle events (job, server and benchmark start/finish) as JSON lines to PATH, "
+                        "or '-' for stdout")
+    p.add_argument("--quiet", action="store_true",
+                   help="Write job output only to the job logs; the terminal shows just the [main] progress")
+    p.add_argument("-v", "--verbose", action="store_true",
+                   help="Also stream the benchmark script's output (progress bars included) to the terminal")
+    p.add_argument("--kill-strategy", choices=KILL_STRATEGIES, default="pgid",
+                   help="Server teardown: kill its process group, its recorded PID and children, or pkill by "
+                        "pattern (not with --async or several models, where it would hit the other jobs' servers)")
+    p.add_argument("--cleanup", action="store_true",
+                   help="Kill every server recorded in the log directory's PID files and exit")
+    p.add_argument("--cleanup-framework", metavar="NAME", default="",
+                   help="Only kill the named framework's running server (e.g. vllm, sglang) and exit")
+    p.add_argument("--split-by-model", action="store_true",
+                   help="Also write each model's results and logs into results/<model-alias>/")
+    p.add_argument("--combine-results", action="store_true",
+                   help="Merge every results/<model-alias>/results.json into results/combined.json and exit")
+    p.add_argument("--slo-ttft", type=float, default=None, help="TTFT SLO in ms for goodput")
+    p.add_argument("--slo-tpot", type=float, default=None, help="TPOT SLO in ms for goodput")
+    p.add_argument("--append-jsonl", metavar="PATH", default="",
+                   help="Append one JSON line per framework with this run's metrics to PATH")
+    p.add_argument("--csv-output", metavar="PATH", default="",
+                   help="Also write the results table as CSV, one row per framework, model, sweep point and rate")
+    p.add_argument("--max-num-seqs", type=parse_int_list, default=[],
+                   help="Max concurrently scheduled requests per server; comma-separated values sweep, e.g. 64,128")
+    p.add_argument("--concurrency-sweep", type=parse_int_list, default=[],
+                   help="Client-side max in-flight requests; runs the benchmark once per value against the "
+                        "same server, e.g. 1,4,16,64")
+    p.add_argument("--compare-metric", choices=sorted(COMPARE_METRICS), default="throughput",
+                   help="Metric that ranks frameworks and picks the headline winner")
+    p.add_argument("--vllm-version", type=parse_version, default=env.get("VLLM_VERSION") or VLLM_DEFAULT_VERSION,
+                   help=f"vllm release to install, or 'nightly' (env VLLM_VERSION, default {VLLM_DEFAULT_VERSION})")
+    p.add_argument("--sglang-version", type=parse_version,
+                   default=env.get("SGLANG_VERSION") or SGLANG_DEFAULT_VERSION,
+                   help=f"sglang release to install (env SGLANG_VERSION, default {SGLANG_DEFAULT_VERSION})")
+    p.add_argument("--vllm-extra-args", type=parse_shell_args, default="",
+                   help="Extra flags appended to 'vllm serve', split like a shell command line, "
+                        "e.g. \"--max-model-len 8192 --quantization fp8\"")
+    p.add_argument("--sglang-extra-args", type=parse_shell_args, default="",
+                   help="Extra flags appended to sglang.launch_server, split like a shell command line")
+    p.add_argument("--flashinfer-index", type=parse_index_url,
+                   default=env.get("FLASHINFER_INDEX") or FLASHINFER_DEFAULT_INDEX,
+                   help="flashinfer wheel --find-links URL matching your CUDA/torch (env FLASHINFER_INDEX)")
+    p.add_argument("--frameworks", type=parse_csv_list, default=None,
+                   help="Comma-separated frameworks to benchmark, in order "
+                        "(default vllm,sglang; also tgi, llamacpp, ollama)")
+    p.add_argument("--tgi", action="store_true",
+                   help="Also benchmark HuggingFace TGI (local text-generation-launcher, else Docker)")
+    p.add_argument("--tgi-version", type=parse_version, default=env.get("TGI_VERSION") or TGI_DEFAULT_VERSION,
+                   help=f"TGI Docker image tag (env TGI_VERSION, default {TGI_DEFAULT_VERSION})")
+    p.add_argument("--gguf-model", default="", metavar="PATH",
+                   help="GGUF file llama.cpp serves; --model still names the HF model used to build prompts")
+    p.add_argument("--llamacpp-ref", type=parse_git_ref, default=LLAMACPP_DEFAULT_REF,
+                   help=f"llama.cpp tag or commit built when llama-server is not on PATH (default {LLAMACPP_DEFAULT_REF})")
+    p.add_argument("--ollama-model", default="", metavar="TAG",
+                   help="Ollama tag the ollama framework pulls and serves, e.g. llama3.1:8b-instruct-fp16; "
+                        "--model still names the HF model used to build prompts")
+    p.add_argument("--vllm-precompiled", choices=["true", "false"], default=None,
+                   help="Install vllm source checkouts with precompiled kernels (false compiles from scratch; "
+                        "default true, but false with --vllm-commit-a/-b so each commit runs its own kernels)")
+    p.add_argument("--reference-framework", default="",
+                   help="Framework all comparison deltas are relative to (default: first to succeed)")
+    p.add_argument("--vllm-commit-a", type=parse_git_ref, default="",
+                   help="Baseline vllm source commit to benchmark")
+    p.add_argument("--vllm-commit-b", type=parse_git_ref, default="",
+                   help="vllm source commit to compare against --vllm-commit-a")
+    p.add_argument("--benchmark-compare-ref", type=parse_git_ref, default="",
+                   help="Commit, tag or branch of benchmark-compare to check out (default: its HEAD)")
+    p.add_argument("--vllm-ref", type=parse_git_ref, default="benchmark-output",
+                   help="Commit, tag or branch of vllm providing the benchmark client (default benchmark-output)")
+    p.add_argument("--no-proxy-localhost", choices=["true", "false"], default="true",
+                   help="Add localhost to NO_PROXY so readiness polling and the benchmark client skip "
+                        "HTTP(S)_PROXY (default true)")
+    p.add_argument("--uv-version", type=parse_version, default=env.get("UV_VERSION", ""),
+                   help="Install this uv release, replacing a different one already on PATH (default: any uv)")
+    p.add_argument("--uv-sha", type=parse_sha256, default=env.get("UV_INSTALLER_SHA256", ""),
+                   help="SHA-256 the downloaded uv install script must match before it is run")
+    p.add_argument("--keep-venvs", action="store_true",
+                   help="Reuse existing framework venvs that already have the requested version installed")
+    p.add_argument("--reuse-repos", action="store_true",
+                   help="Fetch and check out existing benchmark-compare and vllm clones instead of re-cloning them")
+    p.add_argument("--clone-retries", type=int, default=3,
+                   help="Attempts for each git clone/checkout during setup, with exponential backoff")
+    p.add_argument("--gpu-busy-threshold", type=float, default=90.0,
+                   help="Memory/utilization percent above which a GPU is considered busy")
+    p.add_argument("--wait-for-gpu", action="store_true",
+                   help="Wait for busy GPUs to free up instead of aborting (at most until --timeout)")
+    args = p.parse_args(argv)
+    if args.timeout_scale <= 0:
+        p.error("--timeout-scale must be positive")
+    if args.repeat < 1:
+        p.error("--repeat must be at least 1")
+    if args.tensor_parallel < 1:
+        p.error("--tp must be at least 1")
+    args.models = list(dict.fromkeys(m.strip() for m in args.models + args.models_csv if m.strip())) or [DEFAULT_MODEL]
+    # an empty flag or env var means the default, never "vllm=="; argparse also runs
+    # the type validators on env-provided string defaults
+    args.vllm_version = args.vllm_version or VLLM_DEFAULT_VERSION
+    args.sglang_version = args.sglang_version or SGLANG_DEFAULT_VERSION
+    args.flashinfer_index = args.flashinfer_index or FLASHINFER_DEFAULT_INDEX
+    if args.frameworks is not None and args.vllm_commit_a:
+        p.error("--frameworks does not apply to --vllm-commit-a/--vllm-commit-b runs")
+    args.frameworks = list(dict.fromkeys((args.frameworks or DEFAULT_FRAMEWORKS) + (["tgi"] if args.tgi else [])))
+    unknown = [f for f in args.frameworks if f not in JOB_CLASSES]
+    if unknown:
+        p.error(f"unknown framework(s) {', '.join(unknown)}; valid options: {', '.join(JOB_CLASSES)}")
+    if "llamacpp" in args.frameworks:
+        if not args.gguf_model:
+            p.error("the llamacpp framework needs --gguf-model")
+        if not Path(args.gguf_model).is_file():
+            p.error(f"--gguf-model {args.gguf_model} is not a file")
+        if len(args.models) > 1:
+            p.error("the llamacpp framework serves one --gguf-model, so it needs a single --model")
+        if args.tensor_parallel > 1:
+            p.error("the llamacpp framework does not support --tp")
+    if "ollama" in args.frameworks:
+        if not args.ollama_model:
+            p.error("the ollama framework needs --ollama-model")
+        if len(args.models) > 1:
+            p.error("the ollama framework serves one --ollama-model, so it needs a single --model")
+        if args.tensor_parallel > 1:
+            p.error("the ollama framework does not support --tp")
+    if args.clone_retries < 1:
+        p.error("--clone-retries must be at least 1")
+    if args.run_async and args.nodes:
+        p.error("--async cannot be combined with --nodes")
+    if args.kill_strategy == "pkill" and (args.run_async or len(args.models) > 1):
+        # the pattern matches every server of the framework, including sibling jobs still benchmarking
+        p.error("--kill-strategy pkill cannot be combined with --async or several models")
+    if args.insecure_skip_verify and args.server_scheme == "https" and not env.get("SSL_CERT_FILE"):
+        # the servers would pass readiness and then fail every benchmark request
+        p.error("--insecure-skip-verify only covers this script's own requests; the benchmark client still "
+                "verifies certificates, so set SSL_CERT_FILE to a CA bundle that signs the servers'")
+    if len(set(args.ports)) != len(args.ports):
+        p.error("--ports must not repeat a port")
+    if args.job_retries < 0:
+        p.error("--job-retries must not be negative")
+    if args.ramp_window is not None and args.ramp_window <= 0:
+        p.error("--ramp-window must be positive")
+    if args.temperature is not None and args.temperature < 0:
+        p.error("--temperature must be >= 0")
+    if args.top_p is not None and not 0 < args.top_p <= 1:
+        p.error("--top-p must be in (0, 1]")
+    if args.max_tokens is not None and args.max_tokens <= 0:
+        p.error("--max-tokens must be positive")
+    if args.max_tokens is not None and args.output_len is not None and args.max_tokens != args.output_len:
+        p.error("--max-tokens and --output-len both set the output length; give one")
+    if (args.temperature is not None or args.top_p is not None) and args.client != "vllm":
+        p.error("--temperature and --top-p need --client vllm")
+    if args.freeze_prompts is not None and args.client != "vllm":
+        p.error("--freeze-prompts needs --client vllm")
+    if args.concurrency_sweep and args.client != "vllm":
+        p.error("--concurrency-sweep needs --client vllm")
+    if args.client == "guidellm":
+        # the script's guidellm branch passes none of these on, so they would be silently ignored
+        given = {"--request-timeout": args.request_timeout is not None, "--header": bool(args.headers),
+                 "--stream false": args.stream == "false", "--slo-ttft": args.slo_ttft is not None,
+                 "--slo-tpot": args.slo_tpot is not None}
+        unsupported = [flag for flag, on in given.items() if on]
+        if unsupported:
+            p.error(f"{', '.join(unsupported)} need --client vllm")
+    if (args.min_throughput or args.max_ttft) and args.client != "vllm":
+        # the checks read results.json, which only the vllm client writes
+        p.error("--min-throughput and --max-ttft need --client vllm")
+    if bool(args.vllm_commit_a) != bool(args.vllm_commit_b):
+        p.error("--vllm-commit-a and --vllm-commit-b must be given together")
+    if args.vllm_commit_a and commit_label(args.vllm_commit_a) == commit_label(args.vllm_commit_b):
+        p.error(f"--vllm-commit-a and --vllm-commit-b both map to {commit_label(args.vllm_commit_a)}; "
+                "the comparison needs two distinct commits")
+    if args.vllm_precompiled is None:
+        # precompiled wheels come from one nightly, so both commits would run the same kernels
+        args.vllm_precompiled = "false" if args.vllm_commit_a else "true"
+    return args
+
+
+# wall-clock time the whole run must finish by (--timeout), or None
+RUN_DEADLINE = None
+
+
+# --job-timeout deadline of the job running on this thread, set by run_job
+JOB_DEADLINE = threading.local()
+
+
+class DeadlineExceeded(TimeoutError):
+    """--timeout or, when job_timeout is set, this job's --job-timeout ran out."""
+
+    def __init__(self, message, job_timeout=False):
+        super().__init__(message)
+        self.job_timeout = job_timeout
+
+
+def current_deadline():
+    """(unix time, what it limits, whether it is --job-timeout) of the earliest deadline on this thread."""
+    deadlines = [(RUN_DEADLINE, "run exceeded --timeout", False),
+                 (getattr(JOB_DEADLINE, "at", None), "job exceeded --job-timeout", True)]
+    return min(((at, what, job) for at, what, job in deadlines if at is not None), default=(None, None, False))
 
 
-def run_cmd(cmd, cwd=None, logfile=None, logger=None):
+def remaining_time():
+    """Seconds left before the current deadline, or None without one; raises once it has passed."""
+    deadline, what, job_timeout = current_deadline()
+    if deadline is None:
+        return None
+    left = deadline - time.time()
+    if left <= 0:
+        raise DeadlineExceeded(what, job_timeout)
+    return left
+
+
+class JsonFormatter(logging.Formatter):
+    """One JSON object per line with timestamp, level, job and message, for log shippers."""
+
+    def format(self, record):
+        return json.dumps({
+            "timestamp": datetime.datetime.fromtimestamp(record.created, datetime.timezone.utc).isoformat(),
+            "level": record.levelname.lower(),
+            "job": record.name,
+            "message": record.getMessage(),
+        }, ensure_ascii=False)
+
+
+# values replaced by *** in every orchestrator log line, e.g. the HF token
+LOG_SECRETS = []
+
+
+class RedactFilter(logging.Filter):
+    def filter(self, record):
+        msg = record.getMessage()
+        for secret in LOG_SECRETS:
+            msg = msg.replace(secret, "***")
+        record.msg, record.args = msg, None
+        return True
+
+
+# stream --events lines are written to; None disables them
+EVENT_STREAM = None
+EVENT_LOCK = threading.Lock()
+
+
+def emit_event(event, **fields):
+    """Write one lifecycle event as a JSON line for external monitors; separate from the logs."""
+    if EVENT_STREAM is None:
+        return
+    line = json.dumps({"timestamp": datetime.datetime.now(datetime.timezone.utc).isoformat(),
+                       "event": event, **fields}, ensure_ascii=False, default=str)
+    for secret in LOG_SECRETS:
+        line = line.replace(secret, "***")
+    # concurrent jobs share the stream
+    with EVENT_LOCK:
+        EVENT_STREAM.write(line + "\n")
+        EVENT_STREAM.flush()
+
+
+PROXY_VARS = ["HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "NO_PROXY"]
+LOOPBACK_HOSTS = ["localhost", "127.0.0.1", "::1"]
+
+
+def proxy_settings(environ):
+    """Proxy variables in effect (either case), with any credentials in their URLs masked."""
+    found = {}
+    for var in PROXY_VARS:
+        val = environ.get(var.lower()) or environ.get(var)
+        if val:
+            found[var] = re.sub(r"//[^/@]*@", "//***@", val)
+    return found
+
+
+def bypass_proxy_for_loopback(environ):
+    """Add the loopback hosts to NO_PROXY and no_proxy, which requests, curl and aiohttp all honor."""
+    hosts = []
+    for val in (environ.get("no_proxy", ""), environ.get("NO_PROXY", "")):
+        hosts += [h.strip() for h in val.split(",") if h.strip()]
+    hosts = list(dict.fromkeys(hosts + LOOPBACK_HOSTS))
+    environ["NO_PROXY"] = environ["no_proxy"] = ",".join(hosts)
+
+
+def log_handler(stream, log_format="text"):
+    handler = logging.StreamHandler(stream)
+    handler.addFilter(RedactFilter())
+    if log_format == "json":
+        handler.setFormatter(JsonFormatter())
+    return handler
+
+
+def copy_output(src, dests):
+    """Copy a pipe to every text stream in dests as output arrives, until it closes."""
+    decoder = codecs.getincrementaldecoder("utf-8")(errors="replace")
+    while chunk := os.read(src.fileno(), 65536):
+        text = decoder.decode(chunk)
+        for dest in dests:
+            dest.write(text)
+            dest.flush()
+
+
+# process groups of the commands run_cmd is waiting on, killed by the signal handler: in --async
+# runs the job threads are daemons and die without reaching run_cmd's own cleanup
+RUNNING_COMMANDS = set()
+RUNNING_COMMANDS_LOCK = threading.Lock()
+
+
+def kill_running_commands():
+    with RUNNING_COMMANDS_LOCK:
+        pgids = list(RUNNING_COMMANDS)
+    for pgid in pgids:
+        with contextlib.suppress(ProcessLookupError):
+            os.killpg(pgid, signal.SIGKILL)
+
+
+def run_cmd(cmd, cwd=None, logfile=None, logger=None, echo=None):
+    """Run cmd to completion; on --timeout or interruption its whole process group is killed.
+
+    With echo, stdout and stderr still go to logfile and are also copied to echo as they arrive.
+    """
     if logger:
         logger.info(f"▶ {' '.join(cmd)}")
-    proc = subprocess.run(cmd, cwd=cwd, stdout=logfile or sys.stdout, stderr=logfile or sys.stderr)
-    proc.check_returncode()
+    if echo:
+        proc = subprocess.Popen(cmd, cwd=cwd, stdout=subprocess.PIPE, stderr=subprocess.STDOUT,
+                                start_new_session=True)
+        pump = threading.Thread(target=copy_output, args=(proc.stdout, [logfile or sys.stdout, echo]),
+                                daemon=True)
+        pump.start()
+    else:
+        proc = subprocess.Popen(cmd, cwd=cwd, stdout=logfile or sys.stdout, stderr=logfile or sys.stderr,
+                                start_new_session=True)
+        pump = None
+    # start_new_session made its pid the process group id
+    with RUNNING_COMMANDS_LOCK:
+        RUNNING_COMMANDS.add(proc.pid)
+    try:
+        proc.wait(timeout=remaining_time())
+    except BaseException as e:
+        with contextlib.suppress(ProcessLookupError):
+            os.killpg(proc.pid, signal.SIGKILL)
+        proc.wait()
+        if isinstance(e, subprocess.TimeoutExpired):
+            _, what, job_timeout = current_deadline()
+            raise DeadlineExceeded(f"{what} while running {' '.join(cmd)}", job_timeout) from None
+        raise
+    finally:
+        with RUNNING_COMMANDS_LOCK:
+            RUNNING_COMMANDS.discard(proc.pid)
+        if pump:
+            pump.join()
+            proc.stdout.close()
+    if proc.returncode:
+        raise subprocess.CalledProcessError(proc.returncode, cmd)
+
+
+def tail_file(path, n=20, max_bytes=65536, start=0):
+    """Last n lines of a text file after byte offset start, reading at most max_bytes; empty if unreadable."""
+    try:
+        with open(path, "rb") as f:
+            f.seek(max(os.fstat(f.fileno()).st_size - max_bytes, start))
+            return "\n".join(f.read().decode(errors="replace").splitlines()[-n:])
+    except OSError:
+        return ""
 
 
-def wait_for_server(host, port, logger, timeout_s=120, interval_s=2):
-    url = f"http://{host}:{port}/v1/models"
-    deadline = time.time() + timeout_s
+# readiness probes take the polling session (anything with requests' get/post) and a per-request timeout
+
+
+def models_ready(base_url, model, headers=None, session=requests, timeout_s=1):
+    return "data" in session.get(f"{base_url}/v1/models", headers=headers, timeout=timeout_s).text
+
+
+def health_ready(base_url, model, headers=None, session=requests, timeout_s=1):
+    return session.get(f"{base_url}/health", headers=headers, timeout=timeout_s).status_code == 200
+
+
+def completion_ready(base_url, model, headers=None, session=requests, timeout_s=1):
+    payload = {"model": model, "prompt": "Hello", "max_tokens": 1}
+    # held to the poll's timeout too; a first generation that is slower just fails until the next poll
+    return session.post(f"{base_url}/v1/completions", json=payload, headers=headers,
+                        timeout=timeout_s).status_code == 200
+
+
+# tried in order; /v1/models first so existing frameworks behave as before
+READINESS_PROBES = [
+    ("/v1/models", models_ready),
+    ("/health", health_ready),
+    ("completion", completion_ready),
+]
+
+
+def default_readiness(base_url, model, headers=None, session=requests, timeout_s=1):
+    """Return the name of the first readiness signal that succeeds, or None.
+
+    When every probe fails with an error (e.g. connection refused) the last error is raised instead.
+    """
+    error, responded = None, False
+    for name, probe in READINESS_PROBES:
+        try:
+            if probe(base_url, model, headers, session=session, timeout_s=timeout_s):
+                return name
+            responded = True
+        except Exception as e:
+            error = e
+    if error is not None and not responded:
+        raise error
+    return None
+
+
+def status_ok(body, status):
+    return status == 200
+
+
+def path_readiness(path, predicate):
+    """Readiness check polling a single endpoint; predicate(body bytes, status code) decides."""
+    def readiness(base_url, model, headers=None, session=requests, timeout_s=1):
+        resp = session.get(f"{base_url}{path}", headers=headers, timeout=timeout_s)
+        return path if predicate(resp.content, resp.status_code) else None
+    return readiness
+
+
+def check_port_available(port):
+    """Raise if something already listens on port, instead of the server failing to bind later."""
+    with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as sock:
+        # a server that just exited may leave TIME_WAIT sockets; those do not block a new bind
+        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        try:
+            sock.bind(("0.0.0.0", port))
+        except OSError as e:
+            raise RuntimeError(f"port {port} is already in use ({e.strerror})") from None
+
+
+def log_scanner(path, offset, marker):
+    """Return a function telling whether regex marker was written to path after byte offset."""
+    pattern = re.compile(marker)
+    state = {"offset": offset, "tail": ""}
+
+    def seen():
+        with open(path, "rb") as f:
+            f.seek(state["offset"])
+            chunk = f.read().decode(errors="replace")
+            state["offset"] = f.tell()
+        text = state["tail"] + chunk
+        # keep a little context so a marker split across two reads still matches
+        state["tail"] = text[-1024:]
+        return bool(pattern.search(text))
+    return seen
+
+
+def wait_for_server(host, port, logger, scheme="http", **kwargs):
+    """wait_for_url for the server listening on host:port."""
+    return wait_for_url(f"{scheme}://{host}:{port}", logger, **kwargs)
+
+
+def wait_for_url(base_url, logger, readiness=default_readiness, model="", headers=None,
+                 timeout_s=120, interval_s=2, request_timeout_s=1, log_ready=None, log_interval_s=0.25,
+                 heartbeat_s=30, proc=None, server_log=None, server_log_offset=0, session=None):
+    """Wait until readiness() succeeds against base_url, or log_ready() sees the server's ready marker if given.
+
+    Each poll's requests give up after request_timeout_s, capped at half of interval_s, so a half-open
+    connection cannot stall the loop. Every heartbeat_s it logs how long it has waited and what the
+    last poll saw. If the server process proc exits first, it fails right away with the exit status
+    and the tail of what it wrote to server_log after server_log_offset. session (default a new
+    requests.Session) is closed after every poll, so no pooled connection outlives it.
+    """
+    session = session or requests.Session()
+    request_timeout_s = min(request_timeout_s, interval_s / 2)
+    start = time.time()
+    limit, what, job_timeout = current_deadline()
+    deadline = min(start + timeout_s, limit or float("inf"))
+    next_poll = start
+    next_heartbeat = start + heartbeat_s if heartbeat_s else float("inf")
+    last_seen = "no poll yet"
     while time.time() < deadline:
+        if proc is not None and proc.poll() is not None:
+            code = proc.returncode
+            how = f"was killed by signal {-code}" if code < 0 else f"exited with code {code}"
+            tail = (f"; last lines of {server_log}:\n{tail_file(server_log, start=server_log_offset)}"
+                    if server_log else "")
+            raise RuntimeError(f"server for {model or base_url} {how} after {time.time() - start:.0f}s, "
+                               f"before it was ready{tail}")
+        if log_ready and log_ready():
+            logger.info(f"Server at {base_url} ready via log marker after {time.time() - start:.1f}s")
+            return "log marker"
+        if time.time() >= next_poll:
+            try:
+                ready_by = readiness(base_url, model, headers, session=session, timeout_s=request_timeout_s)
+            except requests.ConnectionError:
+                ready_by, last_seen = None, "cannot connect yet"
+            except Exception as e:
+                ready_by, last_seen = None, f"last error: {e}"
+            else:
+                last_seen = "the server responds but is not ready"
+            finally:
+                # drop idle keep-alive connections so the next poll cannot reuse a half-open one
+                session.close()
+            if ready_by:
+                logger.info(f"Server at {base_url} ready via {ready_by}")
+                return ready_by
+            next_poll = time.time() + interval_s
+        if time.time() >= next_heartbeat:
+            logger.info(f"Still waiting for {base_url}, {time.time() - start:.0f}s elapsed ({last_seen})")
+            next_heartbeat += heartbeat_s
+        # a log marker or a dying server is checked for between HTTP polls
+        watching = log_ready or proc is not None
+        time.sleep(log_interval_s if watching else max(min(next_poll, next_heartbeat) - time.time(), 0))
+    if limit is not None and limit < start + timeout_s:
+        # the run or job ran out of time before the readiness timeout did
+        raise DeadlineExceeded(f"{what} while waiting for server at {base_url} ({last_seen})", job_timeout)
+    raise TimeoutError(f"Timeout waiting for server at {base_url} to serve {model or 'a model'} "
+                       f"after {time.time() - start:.0f}s ({last_seen})")
+
+
+def read_counter(base_url, name, headers=None, verify=True):
+    """Sum every series of a Prometheus counter on the server's /metrics page."""
+    text = requests.get(f"{base_url}/metrics", headers=headers, timeout=2, verify=verify).text
+    total = None
+    for line in text.splitlines():
+        if line.startswith(name) and line[len(name):len(name) + 1] in ("{", " "):
+            total = (total or 0.0) + float(line.rsplit(" ", 1)[1])
+    return total
+
+
+def sample_throughput(base_url, counter, headers, interval_s, stop, samples, verify=True):
+    """Append (seconds since start, generated tok/s over the last window) until stop is set."""
+    start = last_t = time.time()
+    last = None
+    while not stop.wait(interval_s):
         try:
-            r = requests.get(url, timeout=1)
-            if "data" in r.text:
-                return
-        except Exception:
-            pass
-        time.sleep(interval_s)
-    raise TimeoutError(f"Timeout waiting for server at {url}")
+            value = read_counter(base_url, counter, headers, verify)
+        except (requests.RequestException, ValueError):
+            continue
+        now = time.time()
+        if value is not None and last is not None:
+            samples.append((round(now - start, 2), round((value - last) / (now - last_t), 2)))
+        last, last_t = value, now
+
+
+def time_to_steady_state(samples, fraction=0.9):
+    """Seconds until windowed throughput first reaches fraction of its peak, or None."""
+    if not samples:
+        return None
+    peak = max(tok_s for _, tok_s in samples)
+    if peak <= 0:
+        return None
+    return next(t for t, tok_s in samples if tok_s >= fraction * peak)
+
+
+def nvidia_smi_query(fields, devices):
+    """Rows of nvidia-smi's fields for the given CUDA devices, or all of them; each row is a list of strings."""
+    cmd = ["nvidia-smi", f"--query-gpu={','.join(fields)}", "--format=csv,noheader,nounits"]
+    if devices:
+        cmd += ["-i", devices]
+    out = subprocess.run(cmd, capture_output=True, text=True, check=True).stdout
+    return [[f.strip() for f in line.split(",")] for line in out.strip().splitlines()]
+
+
+def query_gpu_field(field, devices, convert):
+    """Return {index: convert(value)} of one field; GPUs reporting [N/A] or the like are left out."""
+    readings = {}
+    for idx, value in nvidia_smi_query(["index", field], devices):
+        with contextlib.suppress(ValueError):
+            readings[idx] = convert(value)
+    return readings
+
+
+def query_gpu_usage(devices):
+    """Return (index, memory %, utilization %) for the given CUDA devices, or all of them."""
+    rows = nvidia_smi_query(["index", "memory.used", "memory.total", "utilization.gpu"], devices)
+    return [(idx, 100.0 * float(used) / float(total), float(util)) for idx, used, total, util in rows]
+
+
+def collect_gpu_info(devices):
+    """Return [{index, name, memory_total_mib, driver_version}] for the given CUDA devices, or all of them."""
+    rows = nvidia_smi_query(["index", "name", "memory.total", "driver_version"], devices)
+    return [{"index": idx, "name": name, "memory_total_mib": int(mem), "driver_version": driver}
+            for idx, name, mem, driver in rows]
+
+
+def query_gpu_power(devices):
+    """Return {index: watts}; GPUs without power telemetry are left out."""
+    return query_gpu_field("power.draw", devices, float)
+
 
+def query_gpu_memory(devices):
+    """Return {index: MiB in use} of the given GPUs."""
+    return query_gpu_field("memory.used", devices, int)
 
-def ensure_uv(logger):
+
+def sample_gpus(query, devices, interval_s, stop, samples):
+    """Append (unix time, query(devices)) until stop is set; failed or empty readings are skipped."""
+    while True:
+        try:
+            reading = query(devices)
+        except (OSError, subprocess.CalledProcessError, ValueError):
+            reading = {}
+        if reading:
+            samples.append((time.time(), reading))
+        if stop.wait(interval_s):
+            return
+
+
+@contextlib.contextmanager
+def sampling(sample, *args, done, **kwargs):
+    """Run sample(*args, stop, samples, **kwargs) in a thread around the block, then pass done the samples."""
+    samples, stop = [], threading.Event()
+    sampler = threading.Thread(target=sample, args=(*args, stop, samples), kwargs=kwargs, daemon=True)
+    sampler.start()
+    try:
+        yield
+    finally:
+        stop.set()
+        sampler.join()
+        done(samples)
+
+
+def integrate_energy(samples):
+    """Joules from (time, watts) samples by the trapezoidal rule."""
+    return sum((t1 - t0) * (w0 + w1) / 2 for (t0, w0), (t1, w1) in zip(samples, samples[1:]))
+
+
+def check_gpu_free(cfg, logger, interval_s=30):
+    while True:
+        try:
+            usage = query_gpu_usage(cfg.cuda_device)
+        except (OSError, subprocess.CalledProcessError, ValueError) as e:
+            logger.warning(f"Skipping GPU busy check: {e}")
+            return
+        busy = [u for u in usage if max(u[1], u[2]) >= cfg.gpu_busy_threshold]
+        if not busy:
+            return
+        desc = ", ".join(f"GPU {i} ({mem:.0f}% memory, {util:.0f}% util)" for i, mem, util in busy)
+        if not cfg.wait_for_gpu:
+            raise RuntimeError(f"{desc} above the {cfg.gpu_busy_threshold:g}% busy threshold; "
+                               "another job is likely using it (rerun with --wait-for-gpu to queue)")
+        # --timeout bounds the wait too; raises DeadlineExceeded once it has run out
+        left = remaining_time()
+        logger.info(f"{desc} busy; waiting {interval_s}s for it to free up…")
+        time.sleep(interval_s if left is None else min(interval_s, left))
+
+
+def warmup_server(base_url, model, logger, num_requests=0, duration_s=0, timeout_s=60, headers=None,
+                  verify=True):
+    """Send warmup completions for a fixed count or, failing that, a fixed duration."""
+    if not num_requests and not duration_s:
+        return
+    url = f"{base_url}/v1/completions"
+    payload = {"model": model, "prompt": "Hello, my name is", "max_tokens": 16}
+    deadline = time.time() + duration_s
+    sent = failed = 0
+    while sent < num_requests if num_requests else time.time() < deadline:
+        try:
+            requests.post(url, json=payload, headers=headers, timeout=timeout_s, verify=verify).raise_for_status()
+        except requests.RequestException as e:
+            failed += 1
+            logger.warning(f"Warmup request failed: {e}")
+        sent += 1
+    logger.info(f"Warmup sent {sent} requests ({failed} failed)")
+
+
+def sample_request(base_url, payload, headers=None, timeout_s=60, verify=True):
+    """Send one completion and return the exchange (header values masked) for --debug-requests."""
+    url = f"{base_url}/v1/completions"
+    sample = {"request": {"url": url, "headers": {k: "***" for k in headers or {}}, "json": payload}}
+    start = time.time()
+    try:
+        resp = requests.post(url, json=payload, headers=headers, timeout=timeout_s, verify=verify)
+    except requests.RequestException as e:
+        sample["error"] = str(e)
+        return sample
+    try:
+        body = resp.json()
+    except ValueError:
+        body = resp.text
+    sample["response"] = {"status": resp.status_code, "seconds": round(time.time() - start, 3), "body": body}
+    return sample
+
+
+# fixed prompts answered greedily by every framework for --compare-output-correctness
+CORRECTNESS_PROMPTS = [
+    "The capital of France is",
+    "List the first five prime numbers:",
+    "Translate to German: Good morning, how are you?",
+    "def fibonacci(n):",
+]
+
+
+def collect_outputs(base_url, model, timeout_s=60, headers=None, max_tokens=32, verify=True):
+    """Greedy completions for CORRECTNESS_PROMPTS; None where a request failed."""
+    url = f"{base_url}/v1/completions"
+    outputs = []
+    for prompt in CORRECTNESS_PROMPTS:
+        payload = {"model": model, "prompt": prompt, "max_tokens": max_tokens, "temperature": 0}
+        try:
+            resp = requests.post(url, json=payload, headers=headers, timeout=timeout_s, verify=verify)
+            resp.raise_for_status()
+            outputs.append(resp.json()["choices"][0]["text"])
+        except (requests.RequestException, ValueError, KeyError, IndexError):
+            outputs.append(None)
+    return outputs
+
+
+def degenerate_output(text):
+    """Why a completion looks broken, or None if it looks sensible."""
+    if text is None:
+        return "request failed"
+    words = text.split()
+    if not words:
+        return "empty"
+    if len(words) >= 8 and len(set(words)) <= 2:
+        return "repetitive"
+    return None
+
+
+def check_output_correctness(jobs, reference, logger, min_similarity=0.3):
+    """Flag frameworks with degenerate outputs or outputs wildly different from the reference's."""
+    checked = [j for j in jobs if j.correctness_outputs]
+    for job in checked:
+        ref_job = next((j for j in checked if j.framework == reference and j.model == job.model), None)
+        issues = []
+        for prompt, text in zip(CORRECTNESS_PROMPTS, job.correctness_outputs):
+            reason = degenerate_output(text)
+            if reason:
+                issues.append(f"{prompt!r}: {reason}")
+        if ref_job and job is not ref_job and not issues:
+            pairs = [(a, b) for a, b in zip(ref_job.correctness_outputs, job.correctness_outputs) if a and b]
+            similarity = sum(difflib.SequenceMatcher(None, a, b).ratio() for a, b in pairs) / max(len(pairs), 1)
+            if similarity < min_similarity:
+                issues.append(f"outputs differ from {reference} (similarity {similarity:.2f})")
+        job.output_correct = not issues
+        for issue in issues:
+            logger.warning(f"⚠ OUTPUT CORRECTNESS: {job.framework} {issue}")
+    if checked and all(j.output_correct for j in checked):
+        logger.info(f"✓ Outputs of {', '.join(j.framework for j in checked)} look sensible")
+
+
+def query_ecc_errors(devices):
+    """Return {index: uncorrected ECC error count}; GPUs without ECC reporting are left out."""
+    return query_gpu_field("ecc.errors.uncorrected.aggregate.total", devices, int)
+
+
+def check_gpu_ecc(cfg, logger):
+    try:
+        counts = query_ecc_errors(cfg.cuda_device)
+    except (OSError, subprocess.CalledProcessError, ValueError) as e:
+        logger.warning(f"Skipping GPU ECC check: {e}")
+        return
+    bad = {idx: n for idx, n in counts.items() if n}
+    if not bad:
+        return
+    desc = ", ".join(f"GPU {idx} ({n} uncorrected)" for idx, n in bad.items())
+    if cfg.abort_on_gpu_ecc_error:
+        raise RuntimeError(f"uncorrected ECC errors on {desc}; results on this hardware are not trustworthy")
+    logger.warning(f"⚠ uncorrected ECC errors on {desc}")
+
+
+def preflight_model(model, token=""):
+    """Raise if a model id that is not a local directory cannot be downloaded from the Hugging Face Hub.
+
+    Network errors propagate as requests exceptions so the caller can decide whether they are fatal.
+    """
+    if Path(model).is_dir():
+        return
+    endpoint = os.getenv("HF_ENDPOINT", "https://huggingface.co").rstrip("/")
+    headers = {"Authorization": f"Bearer {token}"} if token else None
+    r = requests.head(f"{endpoint}/{model}/resolve/main/config.json", headers=headers, timeout=10)
+    error = r.headers.get("X-Error-Code", "")
+    if r.status_code < 400:
+        return
+    if error == "GatedRepo" or r.status_code == 403:
+        hint = "request access on its model page" if token else "pass --hf-token or set HF_TOKEN"
+        raise RuntimeError(f"{model} is gated and this {'token has' if token else 'run has'} no access; {hint}")
+    if r.status_code == 401 and token:
+        raise RuntimeError(f"{model} was not found, or the Hugging Face token is invalid")
+    if r.status_code in (401, 404):
+        raise RuntimeError(f"{model} was not found on the Hugging Face Hub; check the model id "
+                           f"(private and gated models also need --hf-token)")
+    r.raise_for_status()
+
+
+def uv_version():
+    """Version of the uv on PATH, e.g. "0.6.14", or None when there is none."""
     if shutil.which("uv") is None:
+        return None
+    try:
+        # "uv 0.6.14 (a4cec56dc 2025-04-09)"
+        out = subprocess.run(["uv", "--version"], capture_output=True, text=True, check=True).stdout.split()
+    except (OSError, subprocess.CalledProcessError):
+        return None
+    return out[1] if len(out) > 1 else None
+
+
+def ensure_uv(logger, version="", sha256=""):
+    """Install uv unless it is on PATH, reinstalling when it is not the pinned version.
+
+    The install script is downloaded and hashed before it runs; with sha256 a different script is refused.
+    """
+    found = uv_version()
+    if found and (not version or found == version):
+        return
+    if found:
+        logger.info(f"`uv` {found} does not match --uv-version {version}; reinstalling via astral.sh...")
+    else:
         logger.info("`uv` not found; installing via astral.sh...")
-        run_cmd(["bash", "-c", "curl -LsSf https://astral.sh/uv/install.sh | sh"], logger=logger)
+    # astral.sh serves each release's installer under its version
+    url = UV_INSTALLER.replace("/uv/", f"/uv/{version}/") if version else UV_INSTALLER
+    with tempfile.TemporaryDirectory() as tmp:
+        script = Path(tmp) / "uv-install.sh"
+        run_cmd(["curl", "-LsSf", "-o", str(script), url], logger=logger)
+        digest = hashlib.sha256(script.read_bytes()).hexdigest()
+        if sha256 and digest != sha256:
+            raise RuntimeError(f"{url} has SHA-256 {digest}, not the pinned {sha256}; refusing to run it")
+        logger.info(f"uv install script SHA-256 {digest}" + (" (verified)" if sha256 else ""))
+        run_cmd(["sh", str(script)], logger=logger)
+    if version and uv_version() != version:
+        raise RuntimeError(f"installed uv {version}, but the `uv` on PATH ({shutil.which('uv') or 'none'}) is "
+                           f"{uv_version() or 'not runnable'}; put the installer's bin directory first on PATH")
+
+
+def build_source_venv(src_dir, venv_dir, logfile, logger, precompiled=True):
+    """Create venv_dir and install the vllm checkout at src_dir into it."""
+    logger.info(f"Creating {venv_dir} from {src_dir}")
+    run_cmd(["uv", "venv", str(venv_dir), "--python", "3.12"],
+            cwd=src_dir, logfile=logfile, logger=logger)
+    # vllm treats any non-empty VLLM_USE_PRECOMPILED as true, so unset it to compile
+    deps_cmd = (
+        f"source {venv_dir}/bin/activate && "
+        f"{'export VLLM_USE_PRECOMPILED=1' if precompiled else 'unset VLLM_USE_PRECOMPILED'} && "
+        "uv pip install -e . && "
+        "uv pip install numpy pandas datasets"
+    )
+    logger.info(f"▶ {deps_cmd}")
+    run_cmd(["bash", "-c", deps_cmd],
+            cwd=src_dir, logfile=logfile, logger=logger)
+
+
+def resolve_bench_script(bench_dir, cfg, logger):
+    """Prefer the specialized script for the exact input/output pair, else the generic one."""
+    if cfg.bench_script:
+        return cfg.bench_script
+    specialized = f"benchmark_{cfg.input_len}_in_{cfg.output_len}_out.sh"
+    if (bench_dir / specialized).is_file():
+        return specialized
+    logger.info(f"No {specialized} in benchmark-compare; using the parameterized {DEFAULT_BENCH_SCRIPT}")
+    return DEFAULT_BENCH_SCRIPT
+
+
+def check_bench_script(bench_dir, script):
+    """Fail before any server starts if the scenario script is not a file inside bench_dir."""
+    path = (bench_dir / script).resolve()
+    if not path.is_relative_to(bench_dir.resolve()):
+        raise RuntimeError(f"--bench-script {script!r} must be inside {bench_dir}")
+    if not path.is_file():
+        scripts = ", ".join(sorted(p.name for p in bench_dir.glob("benchmark_*.sh")))
+        raise RuntimeError(f"benchmark script {script!r} not found in {bench_dir} (available: {scripts or 'none'})")
+
+
+def clone_repo(url, dest, logger, ref=None, retries=3, backoff_s=5):
+    """Clone url into dest (and check out ref), retrying with exponential backoff."""
+    for attempt in range(1, retries + 1):
+        logger.info(f"Cloning {url} (attempt {attempt}/{retries})")
+        try:
+            run_cmd(["git", "clone", url, str(dest)], logger=logger)
+            if ref:
+                run_cmd(["git", "-C", str(dest), "checkout", ref], logger=logger)
+            return
+        except subprocess.CalledProcessError as e:
+            # a partial clone would make the next git clone refuse the destination
+            shutil.rmtree(dest, ignore_errors=True)
+            if attempt == retries:
+                raise
+            delay = backoff_s * 2 ** (attempt - 1)
+            logger.warning(f"⚠ cloning {url} failed ({e}); retrying in {delay}s")
+            time.sleep(delay)
+
+
+def update_repo(url, dest, logger, ref=None):
+    """Reset an existing clone of url to ref (default: the remote's default branch), like a fresh clone.
+
+    Returns False if dest is missing, not a clone of url, or git fails, so the caller can clone from scratch.
+    """
+    if not (dest / ".git").exists():
+        return False
+    remote = subprocess.run(["git", "-C", str(dest), "remote", "get-url", "origin"],
+                            capture_output=True, text=True).stdout.strip()
+    if remote.removesuffix("/").removesuffix(".git") != url.removesuffix(".git"):
+        logger.warning(f"⚠ {dest} is not a clone of {url} (origin {remote or 'missing'}); re-cloning")
+        return False
+    logger.info(f"Updating existing clone {dest}")
+    try:
+        run_cmd(["git", "-C", str(dest), "fetch", "--tags", "--force", "origin"], logger=logger)
+        # branches are checked out at the fetched tip, not a stale local branch
+        target = f"origin/{ref}" if ref else "origin/HEAD"
+        if ref and subprocess.run(["git", "-C", str(dest), "rev-parse", "--verify", "--quiet", target],
+                                  capture_output=True).returncode:
+            target = ref
+        run_cmd(["git", "-C", str(dest), "checkout", "--force", "--detach", target], logger=logger)
+        # drops earlier results and build output; nested clones such as benchmark-compare/vllm are kept
+        run_cmd(["git", "-C", str(dest), "clean", "-fdx"], logger=logger)
+        # worktrees of earlier --vllm-commit-a/-b runs are removed before they are re-added
+        run_cmd(["git", "-C", str(dest), "worktree", "prune"], logger=logger)
+    except subprocess.CalledProcessError as e:
+        logger.warning(f"⚠ updating {dest} failed ({e}); re-cloning")
+        return False
+    return True
+
+
+def git_head(repo):
+    out = subprocess.run(["git", "-C", str(repo), "rev-parse", "HEAD"], capture_output=True, text=True)
+    return out.stdout.strip() if out.returncode == 0 else None
 
 
-def global_setup(root_dir, logger):
-    to_remove = [
-        root_dir / "benchmark-compare",
-        root_dir / "venv-vllm",
-        root_dir / "venv-vllm-src",
-        root_dir / "venv-sgl",
-    ]
+def venv_has(venv_dir, dist, version=None):
+    """Whether venv_dir is a complete venv with dist (at version, if given) installed."""
+    if not (venv_dir / "bin" / "activate").is_file():
+        return False
+    check = ("import sys, importlib.metadata as m; "
+             f"sys.exit(0 if {version!r} in (None, m.version({dist!r})) else 1)")
+    return subprocess.run([str(venv_dir / "bin" / "python"), "-c", check], capture_output=True).returncode == 0
+
+
+def check_tensor_parallel(cfg, logger):
+    devices = len(cfg.gpu_info) or cuda_device_count(cfg.cuda_device)
+    if cfg.tensor_parallel > 1 and devices and devices != cfg.tensor_parallel:
+        logger.warning(f"⚠ --tp {cfg.tensor_parallel} but {devices} CUDA device(s) are visible; "
+                       f"set --cuda-device to exactly {cfg.tensor_parallel} GPU(s)")
+
+
+def preflight_models(cfg, logger):
+    """Check every model before setup; an unreachable Hub only warns, it may be mirrored or cached."""
+    for model in cfg.models:
+        try:
+            preflight_model(model, cfg.hf_token)
+        except requests.RequestException as e:
+            logger.warning(f"⚠ Could not check {model} on the Hugging Face Hub: {e}")
+        else:
+            logger.info(f"✓ {model} is accessible")
+
+
+def global_setup(root_dir, cfg, logger):
+    to_remove = [root_dir / "venv-bench-client"]
+    if not cfg.reuse_repos:
+        to_remove.append(root_dir / "benchmark-compare")
+    # the client venv is always rebuilt: it is an editable install of the fresh vllm clone
+    if not cfg.keep_venvs:
+        to_remove += [root_dir / "venv-vllm", root_dir / "venv-sgl"]
     for p in to_remove:
         logger.info(f"Removing {p}")
         shutil.rmtree(p, ignore_errors=True)
 
-    ensure_uv(logger)
+    ensure_uv(logger, cfg.uv_version, cfg.uv_sha)
+    try:
+        cfg.gpu_info = collect_gpu_info(cfg.cuda_device)
+        for gpu in cfg.gpu_info:
+            logger.info(f"GPU {gpu['index']}: {gpu['name']}, {gpu['memory_total_mib']} MiB, "
+                        f"driver {gpu['driver_version']}")
+    except (OSError, subprocess.CalledProcessError, ValueError) as e:
+        logger.warning(f"⚠ Could not collect GPU info: {e}")
+        cfg.gpu_info = []
 
-    # clone benchmark-compare
-    run_cmd(["git", "clone",
-             "https://github.com/neuralmagic/benchmark-compare.git",
-             str(root_dir / "benchmark-compare")],
-            logger=logger)
-    # clone vllm@benchmark-output
+    # clone benchmark-compare, then vllm@benchmark-output (or --vllm-ref) inside it
     vllm_dir = root_dir / "benchmark-compare" / "vllm"
-    run_cmd(["git", "clone",
-             "https://github.com/vllm-project/vllm.git",
-             str(vllm_dir)],
-            logger=logger)
-    run_cmd(["git", "-C", str(vllm_dir), "checkout", "benchmark-output"],
-            logger=logger)
+    for url, dest, ref in [("https://github.com/neuralmagic/benchmark-compare.git", root_dir / "benchmark-compare",
+                            cfg.benchmark_compare_ref),
+                           ("https://github.com/vllm-project/vllm.git", vllm_dir, cfg.vllm_ref)]:
+        if cfg.reuse_repos and update_repo(url, dest, logger, ref):
+            continue
+        shutil.rmtree(dest, ignore_errors=True)
+        clone_repo(url, dest, logger, ref=ref, retries=cfg.clone_retries)
+    cfg.repo_commits = {"benchmark-compare": git_head(root_dir / "benchmark-compare"), "vllm": git_head(vllm_dir)}
+    for repo, sha in cfg.repo_commits.items():
+        logger.info(f"{repo} is at {sha}")
+
+    # one benchmark client venv, built once and shared by every framework
+    cfg.bench_client_venv = root_dir / "venv-bench-client"
+    # the client never runs vllm's kernels, so they are never compiled for it
+    build_source_venv(vllm_dir, cfg.bench_client_venv, None, logger, precompiled=True)
+    if cfg.client == "guidellm":
+        run_cmd(["bash", "-c", f"source {cfg.bench_client_venv}/bin/activate && uv pip install guidellm"],
+                logger=logger)
+    logger.info(f"Benchmark client installed in {cfg.bench_client_venv}")
+
+
+BUILTIN_BENCH_DEFAULTS = {"input_len": 1000, "output_len": 100, "num_prompts": 2000}
+
+
+def load_bench_defaults(bench_dir, logger):
+    """Read benchmark defaults from the cloned repo's config, falling back to built-ins."""
+    path = bench_dir / "benchmark-config.json"
+    defaults = dict(BUILTIN_BENCH_DEFAULTS)
+    try:
+        with open(path) as f:
+            repo_cfg = json.load(f)
+    except FileNotFoundError:
+        logger.info(f"No {path.name} in benchmark-compare; using built-in benchmark defaults")
+        return defaults
+    except ValueError as e:
+        logger.warning(f"Ignoring malformed {path}: {e}")
+        return defaults
+    if not isinstance(repo_cfg, dict):
+        logger.warning(f"Ignoring malformed {path}: expected a JSON object, got {type(repo_cfg).__name__}")
+        return defaults
+    for key in defaults:
+        val = repo_cfg.get(key)
+        if isinstance(val, int) and not isinstance(val, bool) and val > 0:
+            defaults[key] = val
+        elif val is not None:
+            logger.warning(f"Ignoring invalid {key}={val!r} in {path.name}")
+    return defaults
+
+
+def apply_bench_defaults(cfg, defaults):
+    # flags win over the repo config
+    for key, val in defaults.items():
+        if getattr(cfg, key) is None:
+            setattr(cfg, key, val)
+
+
+# where the benchmark script may leave its results, relative to benchmark-compare
+RESULTS_CANDIDATES = ["results.json", "results/results.json", "vllm/results.json"]
+
+
+def find_results(bench_dir, framework=None):
+    """Locate the results file, preferring one that already has rows for framework."""
+    existing = [bench_dir / rel for rel in RESULTS_CANDIDATES if (bench_dir / rel).is_file()]
+    for path in existing if framework else []:
+        try:
+            if any(r.get("framework") == framework for r in load_results(path)):
+                return path
+        except (OSError, ValueError):
+            continue
+    if existing:
+        return existing[0]
+    looked = ", ".join(str(bench_dir / rel) for rel in RESULTS_CANDIDATES)
+    raise FileNotFoundError(f"benchmark results not found; looked in {looked}")
+
+
+def write_atomic(path, text):
+    """Replace path's content in one step; a crash or kill mid-write leaves the old file whole."""
+    # same directory, so os.replace never crosses a filesystem
+    tmp = path.with_name(f".{path.name}.{os.getpid()}-{threading.get_ident()}.tmp")
+    try:
+        tmp.write_text(text)
+        os.replace(tmp, path)
+    except BaseException:
+        tmp.unlink(missing_ok=True)
+        raise
+
+
+def load_results(path):
+    """Read the JSON-lines results file written by the benchmark script."""
+    rows = []
+    with open(path) as f:
+        for line in f:
+            line = line.strip()
+            if line:
+                rows.append(json.loads(line))
+    return rows
+
+
+# results metadata keys that tell sweep points of the same framework apart
+# "model" is only recorded when a run benchmarks several models
+SWEEP_KEYS = ["model", "gpu_memory_utilization", "max_num_seqs", "max_concurrency"]
+
+
+def sweep_tags(row):
+    # recent vllm clients record max_concurrency themselves, as null when unlimited
+    return "".join(f" {k}={row[k]}" for k in SWEEP_KEYS if row.get(k) is not None)
+
+
+@dataclasses.dataclass
+class FrameworkResult:
+    """Headline metrics of one benchmark run (one request rate) of a framework."""
+    framework: str
+    model: str
+    variant: str  # sweep settings, e.g. "max_num_seqs=64", empty without a sweep
+    request_rate: object  # a number, or "inf" for the unthrottled run
+    request_throughput: float
+    output_throughput: float
+    mean_ttft_ms: float
+    p99_ttft_ms: float
+    mean_tpot_ms: float
+    # not every client version reports these; None when the row has none
+    median_ttft_ms: float = None
+    median_tpot_ms: float = None
+    p99_tpot_ms: float = None
+    p99_e2el_ms: float = None
+    # the sweep settings in variant as values, without the model
+    settings: dict = dataclasses.field(default_factory=dict)
+    stream: bool = True
+    # temperature, top_p and max_tokens the client sent; None means the server's default
+    sampling: dict = dataclasses.field(default_factory=dict)
+
+    @property
+    def tags(self):
+        """The variant as a suffix of the framework name, e.g. " max_num_seqs=64"."""
+        return f" {self.variant}" if self.variant else ""
+
+
+SAMPLING_KEYS = ["temperature", "top_p", "max_tokens"]
+
+
+def benchmark_result(row):
+    """FrameworkResult from one results.json row in vllm's benchmark_serving format; raises ValueError."""
+    metrics = {}
+    # every float field is a metric; ones defaulting to None are optional
+    for field in (f for f in dataclasses.fields(FrameworkResult) if f.type is float):
+        val = row.get(field.name)
+        if val is None and field.default is None:
+            continue
+        if not isinstance(val, (int, float)) or isinstance(val, bool):
+            raise ValueError(f"benchmark result has no numeric {field.name}: {val!r}")
+        metrics[field.name] = float(val)
+    # the benchmark script records the sampling settings it was given as metadata
+    sampling = {k: row.get(k) for k in SAMPLING_KEYS}
+    settings = {k: row[k] for k in SWEEP_KEYS[1:] if row.get(k) is not None}
+    return FrameworkResult(framework=row.get("framework", "?"), model=row.get("model_id", ""),
+                           variant=sweep_tags(row).strip(), request_rate=row.get("request_rate"),
+                           settings=settings, stream=row.get("stream") != "false", sampling=sampling, **metrics)
+
+
+def load_benchmark_results(path):
+    """FrameworkResult of every row of a results file; raises OSError or ValueError."""
+    return [benchmark_result(r) for r in load_results(path)]
+
+
+def validate_fairness(results):
+    """Messages for every framework whose runs of a model used other sampling settings than the first one's."""
+    def describe(sampling):
+        return ", ".join(f"{k}={'server default' if v is None else v}" for k, v in sorted(sampling.items()))
+
+    used = {}  # model -> framework -> distinct sampling settings
+    for res in results:
+        settings = used.setdefault(res.model, {}).setdefault(res.framework, [])
+        if res.sampling not in settings:
+            settings.append(res.sampling)
+    messages = []
+    for model, by_fw in used.items():
+        (ref_fw, ref), *others = by_fw.items()
+        for fw, settings in [(ref_fw, ref)] + others:
+            if len(settings) > 1:
+                messages.append(f"{fw} on {model} mixed sampling settings: "
+                                + "; ".join(describe(s) for s in settings))
+        for fw, settings in others:
+            if settings != ref:
+                messages.append(f"{fw} on {model} sampled with {'; '.join(describe(s) for s in settings)} "
+                                f"but {ref_fw} with {'; '.join(describe(s) for s in ref)}")
+    return messages
+
+
+def is_timeout_error(err):
+    return "timeout" in err.lower() or "timed out" in err.lower()
+
+
+def summarize_failures(results_path, framework, logger, model=None):
+    """Log timed-out and otherwise failed requests for one framework's runs."""
+    try:
+        rows = [r for r in load_results(results_path) if r.get("framework") == framework
+                and (model is None or r.get("model_id", model) == model)]
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        return
+    timed_out = failed = 0
+    for r in rows:
+        errors = [e for e in r.get("errors") or [] if e]
+        timed_out += sum(1 for e in errors if is_timeout_error(e))
+        failed += r.get("num_prompts", 0) - r.get("completed", 0)
+    failed -= timed_out
+    logger.info(f"{framework}: {timed_out} requests timed out, {max(failed, 0)} other failures")
+
+
+def preload_weights(root_dir, model, logger):
+    """Download model weights into the HF cache so server startup measures load, not download."""
+    venv = "venv-hf"
+    if not (root_dir / venv / "bin" / "activate").exists():
+        run_cmd(["uv", "venv", venv, "--python", "3.12"], cwd=root_dir, logger=logger)
+        run_cmd(["bash", "-c", f"source {venv}/bin/activate && uv pip install huggingface_hub"],
+                cwd=root_dir, logger=logger)
+
+    check = f"from huggingface_hub import snapshot_download; snapshot_download({model!r}, local_files_only=True)"
+    cached = subprocess.run(["bash", "-c", f"source {venv}/bin/activate && python -c {shlex.quote(check)}"],
+                            cwd=root_dir, capture_output=True)
+    if cached.returncode == 0:
+        logger.info(f"{model} weights already cached; skipping download")
+        return
+
+    # servers only load safetensors, skip the original consolidated checkpoints
+    logger.info(f"Downloading {model} weights…")
+    run_cmd(["bash", "-c", f"source {venv}/bin/activate && "
+             f"huggingface-cli download {shlex.quote(model)} --exclude 'original/*' '*.pth'"],
+            cwd=root_dir, logger=logger)
+
+
+# the largest fixed-rate run in benchmark_1000_in_100_out.sh (120s at 35 QPS)
+FROZEN_PROMPTS_MIN = 120 * 35
+
+# the client's ShareGPT loader skips prompts longer than this, or longer than the total with the output
+SHAREGPT_MAX_PROMPT_LEN = 1024
+SHAREGPT_MAX_TOTAL_LEN = 2048
+
+# random token ids decoded to text, like the random dataset, written in ShareGPT format. Decoded ids
+# re-tokenize to a different count, so each prompt is trimmed or padded until the loader's own
+# tokenizer(prompt) count is exactly input_len; a prompt that does not converge fails the run.
+FREEZE_PROMPTS_SCRIPT = """
+import json, random, sys
+from transformers import AutoTokenizer
+model, count, input_len, seed, out = sys.argv[1:]
+count, input_len = int(count), int(input_len)
+tok = AutoTokenizer.from_pretrained(model)
+rng = random.Random(int(seed))
+rows, off = [], 0
+for i in range(count):
+    ids = [rng.randrange(tok.vocab_size) for _ in range(input_len)]
+    for _ in range(20):
+        text = tok.decode(ids)
+        n = len(tok(text).input_ids)
+        if n == input_len:
+            break
+        if n > input_len:
+            ids = ids[:max(1, len(ids) - (n - input_len))]
+        else:
+            ids += [rng.randrange(tok.vocab_size) for _ in range(input_len - n)]
+    else:
+        off += 1
+    rows.append({"id": str(i), "conversations": [{"from": "human", "value": text},
+                                                 {"from": "gpt", "value": ""}]})
+if off or len(rows) != count:
+    sys.exit(f"{off} of {count} prompts do not re-tokenize to exactly {input_len} tokens")
+with open(out, "w") as f:
+    json.dump(rows, f)
+"""
+
+
+def freeze_prompts(cfg, model, logs_dir, logger, seed=0):
+    """Generate model's prompt set once (or reuse the given file) and return (path, sha256 prefix)."""
+    path = Path(cfg.freeze_prompts) if cfg.freeze_prompts else logs_dir / "frozen-prompts.json"
+    if len(cfg.models) > 1:
+        # prompts are tokenized per model, so each model gets its own set
+        path = path.with_name(f"{path.stem}-{sanitize_model_name(model)}{path.suffix}")
+    if cfg.freeze_prompts and path.exists():
+        logger.info(f"Reusing frozen prompt set {path}")
+    else:
+        if cfg.input_len > SHAREGPT_MAX_PROMPT_LEN or cfg.input_len + cfg.output_len > SHAREGPT_MAX_TOTAL_LEN:
+            raise RuntimeError(f"--freeze-prompts needs --input-len <= {SHAREGPT_MAX_PROMPT_LEN} and input + output "
+                               f"<= {SHAREGPT_MAX_TOTAL_LEN} tokens, or the ShareGPT loader drops the prompts")
+        count = max(cfg.num_prompts, FROZEN_PROMPTS_MIN)
+        logger.info(f"Generating {count} frozen prompts of {cfg.input_len} tokens into {path}")
+        path.parent.mkdir(parents=True, exist_ok=True)
+        run_cmd(["bash", "-c", f"source {cfg.bench_client_venv}/bin/activate && "
+                 f"python -c {shlex.quote(FREEZE_PROMPTS_SCRIPT)} {shlex.quote(model)} "
+                 f"{count} {cfg.input_len} {seed} {shlex.quote(str(path.resolve()))}"],
+                logger=logger)
+    digest = hashlib.sha256(path.read_bytes()).hexdigest()[:16]
+    logger.info(f"Prompt set {path.name} sha256 {digest}")
+    return path.resolve(), digest
+
+
+def sanity_violations(rows, min_throughput=None, max_ttft=None):
+    """Check one framework's results against absolute sanity bounds."""
+    violations = []
+    if min_throughput:
+        peak = max((r.get("output_throughput") or 0 for r in rows), default=0)
+        if peak < min_throughput:
+            violations.append(f"peak output throughput {peak:.1f} tok/s is below --min-throughput "
+                              f"{min_throughput:g} (is the server falling back to CPU or the wrong GPU?)")
+    if max_ttft:
+        best = min((r["median_ttft_ms"] for r in rows if r.get("median_ttft_ms") is not None), default=None)
+        if best is not None and best > max_ttft:
+            violations.append(f"best median TTFT {best:.1f} ms is above --max-ttft {max_ttft:g} "
+                              "(is the GPU shared with another job, or the model far too large?)")
+    return violations
+
+
+def process_table():
+    """Yield (pid, state, ppid) for every process visible in /proc."""
+    for stat in Path("/proc").glob("[0-9]*/stat"):
+        try:
+            # the command name may contain spaces, so split after its closing paren
+            fields = stat.read_text().rsplit(")", 1)[1].split()
+        except (OSError, IndexError):
+            continue
+        yield int(stat.parent.name), fields[0], int(fields[1])
+
+
+def defunct_children():
+    """Return pids of this process's children that exited but were never waited on."""
+    return [pid for pid, state, ppid in process_table() if state == "Z" and ppid == os.getpid()]
+
+
+def descendants(pid):
+    children = {}
+    for child, _, ppid in process_table():
+        children.setdefault(ppid, []).append(child)
+    found, stack = [], [pid]
+    while stack:
+        for child in children.get(stack.pop(), []):
+            found.append(child)
+            stack.append(child)
+    return found
+
+
+KILL_STRATEGIES = ["pgid", "pid", "pkill"]
+
+
+# coordination ports for multi-node serving
+RAY_PORT = 6379
+DIST_INIT_PORT = 29500
+
+
+def check_nodes(nodes, logger):
+    """Fail fast if any worker node is unreachable over non-interactive SSH."""
+    for host in nodes[1:]:
+        proc = subprocess.run(["ssh", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10", host, "true"],
+                              capture_output=True, text=True)
+        if proc.returncode != 0:
+            raise RuntimeError(f"cannot reach worker node {host} over SSH: {proc.stderr.strip()}")
+    logger.info(f"Multi-node serving across {', '.join(nodes)} (head {nodes[0]})")
+
+
+# held while a job rewrites or merges into results.json; under --async each job's client writes its
+# own file (BaseJob.own_results), so no client appends in between
+RESULTS_REWRITE_LOCK = threading.Lock()
+
+
+# job kind -> {"lock", and once installed "venv" and "attrs"}; see BaseJob.shared_install
+INSTALLS = {}
+INSTALLS_LOCK = threading.Lock()
+
+
+# running servers by pid -> (job name, stop callback), so a signal handler can kill them
+RUNNING_SERVERS = {}
+# reentrant: the signal handler runs on the main thread, possibly while it holds the lock
+RUNNING_SERVERS_LOCK = threading.RLock()
+
+
+def register_server(proc, name, stop):
+    with RUNNING_SERVERS_LOCK:
+        RUNNING_SERVERS[proc.pid] = (name, stop)
+
+
+def unregister_server(pid):
+    with RUNNING_SERVERS_LOCK:
+        RUNNING_SERVERS.pop(pid, None)
+
+
+def kill_all_servers(logger, job_name=None):
+    with RUNNING_SERVERS_LOCK:
+        running = list(RUNNING_SERVERS.items())
+    for pid, (name, stop) in running:
+        if job_name and name != job_name:
+            continue
+        logger.info(f"Killing {name} server (pid={pid})")
+        try:
+            stop()
+        except (OSError, subprocess.SubprocessError) as e:
+            logger.warning(f"⚠ could not kill {name} server (pid={pid}): {e}")
+        unregister_server(pid)
+
+
+def install_signal_handlers(logger):
+    """On SIGINT/SIGTERM kill every running server and command before exiting, so none keeps holding a GPU."""
+    def handle(signum, frame):
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            signal.signal(sig, signal.SIG_IGN)
+        logger.error(f"✗ Received {signal.Signals(signum).name}; stopping running servers")
+        kill_all_servers(logger)
+        kill_running_commands()
+        sys.exit(128 + signum)
+
+    for sig in (signal.SIGINT, signal.SIGTERM):
+        signal.signal(sig, handle)
+
+
+def pid_file(logs_dir, name):
+    return logs_dir / f"{name}.pid"
+
+
+def kill_recorded_server(logs_dir, name, logger):
+    """Kill the process group recorded in <name>.pid; returns False if nothing was recorded."""
+    path = pid_file(logs_dir, name)
+    try:
+        pgid = int(path.read_text().strip())
+    except (OSError, ValueError):
+        return False
+    try:
+        os.killpg(pgid, signal.SIGKILL)
+        logger.info(f"Killed {name} server process group {pgid}")
+    except ProcessLookupError:
+        logger.info(f"{name} server process group {pgid} already exited")
+    path.unlink(missing_ok=True)
+    return True
+
+
+JOB_PHASES = ["setup", "install", "serve", "ready", "warmup", "benchmark", "teardown"]
 
 
 class BaseJob:
-    def __init__(self, name, cfg, root_dir, logs_dir):
+    framework = None  # value recorded as "framework" in results.json
+    gpu_mem_util_arg = None  # server flag taking the GPU memory fraction
+    max_num_seqs_arg = None  # server flag capping concurrently scheduled requests
+    tensor_parallel_arg = None  # server flag taking the tensor-parallel size
+    extra_args = ()  # user-given server flags, appended last
+    served_model = None  # model name requests must use when the server does not know the HF id
+    version = None
+    serve_pattern = None  # command-line signature of the server, for cleanup without a PID file
+    import_module = None  # timed by --profile-startup
+    generation_counter = None  # Prometheus counter of generated tokens, sampled by --ramp-window
+    # readiness(base_url, model, headers, session=, timeout_s=) returns the signal that showed the server
+    # is ready, or None
+    readiness = staticmethod(default_readiness)
+    # a job with a health_path polls only that endpoint, judged by ready_predicate(body, status)
+    health_path = None
+    ready_predicate = staticmethod(status_ok)
+    # regex the server logs once it accepts requests; seen in the log before HTTP polling notices
+    ready_marker = None
+    # attributes install() sets, copied to the other jobs that share the install
+    install_attrs = ("version",)
+
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        self.cfg = cfg  # run settings are read from here, not copied
+        self.kind = name  # JOB_CLASSES key, before any model suffix
+        if len(cfg.models) > 1:
+            # one job per framework and model; keeps log, PID and logger names apart
+            name = f"{name}-{sanitize_model_name(model)}"
         self.name = name
+        if self.health_path:
+            self.readiness = path_readiness(self.health_path, self.ready_predicate)
         self.port = cfg.port
-        self.model = cfg.model
-        self.cuda_dev = cfg.cuda_device
+        self.model = model
+        self.model_label = [f"model={model}"] if len(cfg.models) > 1 else []
+        self.verify_tls = not cfg.insecure_skip_verify
+        self.prompts_file, self.prompt_set = cfg.prompt_sets.get(model, (None, None))
+        self.headers = dict(cfg.headers)
+        self.install_seconds = None
+        self.import_seconds = None
+        self.sanity_violations = []
+        self.procs = []  # every server launched, so each one gets reaped
+        self.stopped = set()  # pids of servers stop_server already tore down
+        self.phases = dict.fromkeys(JOB_PHASES, False)
+        self.failed_phase = None
+        self.retries = 0
+        self.timed_out = False
+        self.results_path = None
+        self.workers = []  # (host, ssh process) of the worker nodes of the running server
+        self.serve_venv = None  # venv of the running server, which node commands run in too
+        self.ramp_curves = []  # one {labels, samples, time_to_steady_s} per benchmark invocation
+        self.correctness_outputs = []
+        self.output_correct = None  # set by check_output_correctness
+        self.energy_runs = []  # one {labels, joules, wh, output_tokens, j_per_mtok} per benchmark invocation
+        self.gpu_memory_runs = []  # one {labels, peak_mib: {gpu index: MiB}} per benchmark invocation
+        self.bench_results = []  # FrameworkResult of every results row this job wrote
+        self.startup_log = None
+        self.ecc_suspect = False
+        self.bench_runs = []  # bench_params of every benchmark invocation, for the parity check
         self.root_dir = root_dir
+        self.logs_dir = logs_dir
         self.logpath = logs_dir / f"{name}.log"
         self.logfile = open(self.logpath, "a")
         self.logger = logging.getLogger(name)
         self.logger.setLevel(logging.INFO)
-        self.logger.addHandler(logging.StreamHandler(self.logfile))
-        self.logger.addHandler(logging.StreamHandler(sys.stdout))
+        self.logger.addHandler(log_handler(self.logfile, cfg.log_format))
+        if not cfg.quiet:
+            self.logger.addHandler(log_handler(sys.stdout, cfg.log_format))
 
-    def run(self):
+    def install(self):
+        """Install the framework and return the venv (relative to root_dir) to serve from, or None."""
         raise NotImplementedError
 
+    def shared_install(self):
+        """install() once per job kind and run: the jobs of other models reuse it instead of reinstalling.
 
-def run_jobs(jobs, logger):
-    for job in jobs:
-        logger.info(f"▶ Running {job.name}")
+        In --async runs they would otherwise delete the venv another model's server is running from.
+        """
+        with INSTALLS_LOCK:
+            entry = INSTALLS.setdefault(self.kind, {"lock": threading.Lock()})
+        with entry["lock"]:
+            if "venv" in entry:
+                for attr, val in entry["attrs"].items():
+                    setattr(self, attr, val)
+                self.logger.info(f"Reusing the {self.kind} install of this run")
+                return entry["venv"]
+            venv = self.install()
+            entry["attrs"] = {attr: getattr(self, attr) for attr in self.install_attrs}
+            entry["venv"] = venv
+            return venv
+
+    def serve_cmd(self):
+        raise NotImplementedError
+
+    def after_ready(self):
+        """Called once the server answers, before warmup; e.g. to load the model into it."""
+
+    def node_cmd(self, rank, server_args):
+        """Command for node rank of a multi-node server; rank 0 is the head and serves HTTP."""
+        raise RuntimeError(f"{self.name} does not support multi-node serving")
+
+    def node_stop_cmd(self):
+        return f"pkill -9 -f {shlex.quote(self.serve_pattern)}"
+
+    def node_shell(self, cmd):
+        """cmd as run on a node: from root_dir, inside the serving venv (e.g. so ray is on PATH)."""
+        activate = f"source {self.serve_venv}/bin/activate && " if self.serve_venv else ""
+        return f"cd {shlex.quote(str(self.root_dir))} && {activate}{cmd}"
+
+    def start_workers(self, server_args):
+        for rank, host in enumerate(self.cfg.nodes[1:], 1):
+            cmd = self.node_shell(" ".join(self.node_cmd(rank, server_args)))
+            self.logger.info(f"▶ ssh {host} {cmd}")
+            proc = subprocess.Popen(["ssh", "-o", "BatchMode=yes", host, cmd],
+                                    stdout=self.logfile, stderr=self.logfile, preexec_fn=os.setsid)
+            self.procs.append(proc)
+            self.workers.append((host, proc))
+
+    def check_workers(self):
+        for host, proc in self.workers:
+            if proc.poll() is not None:
+                raise RuntimeError(f"{self.name} worker on {host} exited with code {proc.returncode}")
+
+    def stop_workers(self):
+        for host, proc in self.workers:
+            self.logger.info(f"Stopping {self.name} worker on {host}")
+            try:
+                subprocess.run(["ssh", "-o", "BatchMode=yes", host, self.node_shell(self.node_stop_cmd())],
+                               stdout=self.logfile, stderr=self.logfile, timeout=60, check=False)
+            except subprocess.TimeoutExpired:
+                self.logger.warning(f"⚠ stopping the worker on {host} timed out")
+            with contextlib.suppress(ProcessLookupError):
+                os.killpg(os.getpgid(proc.pid), signal.SIGKILL)
+            proc.wait()
+        self.workers = []
+
+    @contextlib.contextmanager
+    def phase(self, name):
+        """Record whether a lifecycle phase succeeded, and the first one that failed."""
         try:
-            job.run()
-            logger.info(f"✓ {job.name} completed")
-        except Exception as e:
-            logger.error(f"✗ {job.name} failed: {e}")
+            yield
+        except BaseException:
+            self.phases[name] = False
+            self.failed_phase = self.failed_phase or name
+            raise
+        self.phases[name] = True
+
+    def server_url(self):
+        # the port is only final once assign_ports has run
+        return f"{self.cfg.server_scheme}://{self.cfg.server_host}:{self.port}"
+
+    def emit(self, event, **fields):
+        emit_event(event, job=self.name, framework=self.framework, **fields)
+
+    def scaled(self, seconds):
+        return seconds * self.cfg.timeout_scale
+
+    def status(self):
+        return {"framework": self.framework, "phases": dict(self.phases), "failed_phase": self.failed_phase,
+                "retries": self.retries, "timed_out": self.timed_out,
+                "install_seconds": self.install_seconds, "import_seconds": self.import_seconds,
+                "ecc_suspect": self.ecc_suspect, "startup_log": str(self.startup_log) if self.startup_log else None,
+                "rampup": self.ramp_curves, "energy": self.energy_runs, "gpu_memory": self.gpu_memory_runs,
+                "results": [dataclasses.asdict(r) for r in self.bench_results],
+                "output_correct": self.output_correct, "sanity_violations": self.sanity_violations}
+
+    def export_startup_log(self, start, serve_cmd):
+        """Copy the server output written since byte offset start into <job>-startup.log."""
+        self.logfile.flush()
+        with open(self.logpath, "rb") as f:
+            f.seek(start)
+            section = f.read()
+        self.startup_log = self.logs_dir / f"{self.name}-startup.log"
+        with open(self.startup_log, "ab") as out:
+            out.write(f"===== {' '.join(serve_cmd)} =====\n".encode())
+            out.write(section)
+        self.logger.info(f"Server startup log saved to {self.startup_log}")
+
+    def ecc_counts(self):
+        if not self.cfg.abort_on_gpu_ecc_error:
+            return {}
+        try:
+            return query_ecc_errors(self.cfg.cuda_device)
+        except (OSError, subprocess.CalledProcessError, ValueError):
+            return {}
+
+    def time_import(self, venv):
+        # a fresh interpreter per measurement so nothing is already imported
+        start = time.time()
+        run_cmd(["bash", "-c", f"source {venv}/bin/activate && python -c 'import {self.import_module}'"],
+                cwd=self.root_dir, logfile=self.logfile, logger=self.logger)
+        self.import_seconds = time.time() - start
+        self.logger.info(f"import {self.import_module} took {self.import_seconds:.2f}s")
+
+    def run(self):
+        self.logger.info(f"=== {self.name} benchmark start ===")
+        # rows an interrupted earlier run left behind were never merged and would be double counted
+        self.own_results().unlink(missing_ok=True)
+        # jobs only start once global setup has succeeded
+        self.phases["setup"] = True
+        start = time.time()
+        with self.phase("install"):
+            venv = self.shared_install()
+        self.install_seconds = time.time() - start
+        self.logger.info(f"{self.name} {self.version} installed in {self.install_seconds:.0f}s")
+        if self.cfg.profile_startup and self.import_module:
+            self.time_import(venv)
+        for server_args, sweep_labels in self.server_variants():
+            self.serve_and_benchmark(venv, server_args, sweep_labels)
+        self.logger.info(f"=== {self.name} benchmark done ===")
+
+    def server_variants(self):
+        """Yield (server args, result labels) for every combination of swept server settings.
+
+        Without any sweep this yields a single run using the framework's defaults.
+        """
+        dims = []
+        for arg, key, values in [(self.gpu_mem_util_arg, "gpu_memory_utilization", self.cfg.gpu_memory_utilization),
+                                 (self.max_num_seqs_arg, "max_num_seqs", self.cfg.max_num_seqs)]:
+            if not values:
+                continue
+            if arg is None:
+                raise RuntimeError(f"{self.name} does not support sweeping {key}")
+            dims.append([(arg, key, v) for v in values])
+        for combo in itertools.product(*dims):
+            args, labels = [], []
+            for arg, key, v in combo:
+                args += [arg, f"{v:g}"]
+                labels.append(f"{key}={v:g}")
+            yield args, labels
+
+    def serve_and_benchmark(self, venv, server_args=(), sweep_labels=()):
+        self.serve_venv = venv
+        if self.cfg.tensor_parallel > 1:
+            if self.tensor_parallel_arg is None:
+                raise RuntimeError(f"{self.name} does not support tensor parallelism")
+            server_args = [self.tensor_parallel_arg, str(self.cfg.tensor_parallel)] + list(server_args)
+        # the command runs through bash (and ssh for workers), so each user token is quoted
+        server_args = list(server_args) + [shlex.quote(a) for a in self.extra_args]
+        serve_cmd = self.node_cmd(0, server_args) if self.cfg.nodes else self.serve_cmd() + list(server_args)
+        labels = (list(self.cfg.labels) + [f"vllm_precompiled={self.cfg.vllm_precompiled}"] + self.model_label
+                  + list(sweep_labels))
+        if self.prompt_set:
+            labels.append(f"prompt_set={self.prompt_set}")
+
+        # launch server
+        env = os.environ.copy()
+        if self.cfg.cuda_device:
+            env["CUDA_VISIBLE_DEVICES"] = self.cfg.cuda_device
+        activate = f"source {venv}/bin/activate && " if venv else ""
+        self.logger.info(f"▶ {activate}{' '.join(serve_cmd)}")
+        self.logfile.flush()
+        startup_offset = self.logpath.stat().st_size
+        with self.phase("serve"):
+            check_port_available(self.port)
+            proc = subprocess.Popen(
+                ["bash", "-c", activate + " ".join(serve_cmd)], cwd=self.root_dir,
+                stdout=self.logfile, stderr=self.logfile,
+                env=env, preexec_fn=os.setsid
+            )
+            self.procs.append(proc)
+            self.logger.info(f"Started {self.name} server (pid={proc.pid})")
+            self.emit("server_started", pid=proc.pid, labels=labels)
+            pid_file(self.logs_dir, self.name).write_text(f"{os.getpgid(proc.pid)}\n")
+            register_server(proc, self.name, lambda: self.stop_server(proc))
+            if self.cfg.nodes:
+                self.start_workers(server_args)
+
+        # the server is stopped even when the benchmark fails, so it never outlives its job
+        try:
+            # wait for ready
+            self.logger.info(f"Waiting for {self.name} to load…")
+            with self.phase("ready"):
+                log_ready = (log_scanner(self.logpath, startup_offset, self.ready_marker)
+                             if self.ready_marker else None)
+                session = requests.Session()
+                session.verify = self.verify_tls
+                wait_for_server(self.cfg.server_host, self.port, self.logger, scheme=self.cfg.server_scheme,
+                                readiness=self.readiness, model=self.model, headers=self.headers,
+                                timeout_s=self.scaled(self.cfg.ready_timeout), log_ready=log_ready,
+                                request_timeout_s=self.scaled(1), interval_s=self.cfg.poll_interval,
+                                proc=proc, server_log=self.logpath,
+                                server_log_offset=startup_offset, session=session)
+                self.check_workers()
+                self.after_ready()
+            self.logger.info(f"{self.name} inference server ready at {self.server_url()}")
+            self.emit("server_ready", port=self.port, labels=labels)
+            if self.cfg.export_startup_logs:
+                self.export_startup_log(startup_offset, serve_cmd)
+            if self.cfg.post_ready_delay:
+                self.logger.info(f"Waiting {self.cfg.post_ready_delay:g}s after ready before benchmarking")
+                time.sleep(self.cfg.post_ready_delay)
+
+            # run benchmark script; concurrency sweeps and repeats reuse the running server
+            warmup = True
+            for concurrency in self.cfg.concurrency_sweep or [None]:
+                point_labels = [f"max_concurrency={concurrency}"] if concurrency else []
+                for n in range(1, self.cfg.repeat + 1):
+                    repeat_labels = [f"repeat={n}"] if self.cfg.repeat > 1 else []
+                    self.run_benchmark(self.framework, labels + point_labels + repeat_labels,
+                                       warmup=warmup, concurrency=concurrency)
+                    warmup = False
+            # an implausible result fails the benchmark phase, so the job never counts as a success
+            with self.phase("benchmark"):
+                self.check_sanity()
+        finally:
+            self.logger.info(f"Stopping {self.name} server (pid={proc.pid})")
+            with self.phase("teardown"):
+                self.stop_server(proc)
+            self.emit("server_stopped", pid=proc.pid)
+
+    def stop_server(self, proc):
+        """Kill a launched server and its worker nodes, and forget it.
+
+        Safe to call again, e.g. from the job's teardown after the signal handler already stopped it.
+        """
+        if proc.pid in self.stopped:
             return
-        if job.name == "vllm":
-            logger.info("Killing vllm serve process group")
-            subprocess.run(["pkill", "-f", "vllm serve"], check=False)
+        self.stopped.add(proc.pid)
+        # engine or TP workers keep the process group alive after its leader exited, so it is always killed
+        with contextlib.suppress(ProcessLookupError, PermissionError):
+            os.killpg(proc.pid, signal.SIGKILL)
+        if proc.returncode is None:
+            self.kill_server(proc)
+        proc.wait()
+        if self.cfg.nodes:
+            self.stop_workers()
+            subprocess.run(["bash", "-c", self.node_shell(self.node_stop_cmd())], stdout=self.logfile,
+                           stderr=self.logfile, check=False)
+        unregister_server(proc.pid)
+        pid_file(self.logs_dir, self.name).unlink(missing_ok=True)
+
+    def kill_server(self, proc):
+        if self.cfg.kill_strategy == "pgid":
+            # the server was started with setsid, so its pid is its process group id
+            with contextlib.suppress(ProcessLookupError):
+                os.killpg(proc.pid, signal.SIGKILL)
+        elif self.cfg.kill_strategy == "pid":
+            # children first so none get re-parented and survive
+            for pid in reversed(descendants(proc.pid)):
+                with contextlib.suppress(ProcessLookupError):
+                    os.kill(pid, signal.SIGKILL)
+            proc.kill()
+        else:
+            subprocess.run(["pkill", "-9", "-f", self.serve_pattern], check=False)
+
+    def reset_attempt(self):
+        """Tear down what a failed attempt left behind so the whole job can run again."""
+        for proc in self.procs:
+            if proc.poll() is None:
+                with contextlib.suppress(ProcessLookupError):
+                    os.killpg(os.getpgid(proc.pid), signal.SIGKILL)
+                proc.wait()
+        self.stop_workers()
+        pid_file(self.logs_dir, self.name).unlink(missing_ok=True)
+        self.drop_results()
+        self.retries += 1
+        self.phases = dict.fromkeys(JOB_PHASES, False)
+        self.failed_phase = None
+        self.bench_runs, self.ramp_curves, self.energy_runs, self.gpu_memory_runs = [], [], [], []
+        self.bench_results = []
+        self.sanity_violations, self.correctness_outputs = [], []
+
+    def drop_results(self):
+        """Remove partial rows a failed attempt wrote, so a retry does not double count."""
+        path = self.results_path
+        if path is None:
+            try:
+                path = find_results(self.root_dir / "benchmark-compare", self.framework)
+            except FileNotFoundError:
+                return
+        with RESULTS_REWRITE_LOCK:
+            try:
+                rows = load_results(path)
+            except (OSError, ValueError):
+                return
+            kept = [r for r in rows if not self.owns(r)]
+            if len(kept) == len(rows):
+                return
+            write_atomic(path, "".join(json.dumps(r) + "\n" for r in kept))
+        self.logger.info(f"Dropped {len(rows) - len(kept)} partial {self.framework} result(s) from {path}")
+
+    def kill_process_groups(self):
+        """SIGKILL whatever is left in the process groups this job launched, and nothing else."""
+        for proc in self.procs + [p for _, p in self.workers]:
+            # each server was started with setsid, so its pid is its process group id
+            with contextlib.suppress(ProcessLookupError, PermissionError):
+                os.killpg(proc.pid, signal.SIGKILL)
+
+    def reap(self, timeout_s=10):
+        """Wait on every launched server and log any that could not be reaped."""
+        for proc in self.procs:
+            try:
+                proc.wait(timeout=timeout_s)
+            except subprocess.TimeoutExpired:
+                self.logger.warning(f"{self.name} server (pid={proc.pid}) is still running and could not be reaped")
+        self.procs = [p for p in self.procs if p.returncode is None]
+
+    def owns(self, row):
+        return row.get("framework") == self.framework and row.get("model_id", self.model) == self.model
+
+    def check_sanity(self):
+        if not self.cfg.min_throughput and not self.cfg.max_ttft:
+            return
+        rows = [r for r in load_results(self.results_path) if self.owns(r)]
+        violations = sanity_violations(rows, self.cfg.min_throughput, self.cfg.max_ttft)
+        if violations:
+            self.sanity_violations.extend(violations)
+            raise RuntimeError("sanity check failed: " + "; ".join(violations))
+
+    def save_sample_request(self):
+        """Record one request shaped like the benchmark's (prompt source and sampling settings) and its response."""
+        prompt = "Hello, my name is"
+        if self.prompts_file:
+            # the frozen ShareGPT set every framework is benchmarked on
+            with contextlib.suppress(OSError, ValueError, LookupError):
+                prompt = json.loads(Path(self.prompts_file).read_text())[0]["conversations"][0]["value"]
+        payload = {"model": self.served_model or self.model, "prompt": prompt,
+                   "max_tokens": self.cfg.max_tokens or self.cfg.output_len, "ignore_eos": True}
+        for key, val in [("temperature", self.cfg.temperature), ("top_p", self.cfg.top_p)]:
+            if val is not None:
+                payload[key] = val
+        sample = sample_request(self.server_url(), payload, self.headers, timeout_s=self.scaled(60),
+                                verify=self.verify_tls)
+        path = self.logs_dir / f"sample-{self.name}.json"
+        path.write_text(json.dumps(sample, indent=2) + "\n")
+        self.logger.info(f"Sample request and response written to {path}")
+
+    def bench_params(self, labels, concurrency=None):
+        """Client settings for one benchmark invocation; these must match across frameworks.
+
+        They reach the script as environment variables, alongside FRAMEWORK:
+        MODEL, CLIENT (vllm|guidellm), STREAM (true|false), INPUT_LEN and OUTPUT_LEN (random
+        prompt token lengths), INF_NUM_PROMPTS (prompts in the infinite-rate run) and, when set,
+        TEMPERATURE, TOP_P, MAX_TOKENS, PROMPTS_FILE, REQUEST_TIMEOUT (seconds), MAX_CONCURRENCY,
+        LABELS (space-separated key=value), HEADERS (newline-separated Name=Value) and GOODPUT.
+        """
+        params = {
+            "MODEL": self.model,
+            "CLIENT": self.cfg.client,
+            "STREAM": self.cfg.stream,
+            "INPUT_LEN": self.cfg.input_len,
+            "OUTPUT_LEN": self.cfg.output_len,
+            "INF_NUM_PROMPTS": self.cfg.num_prompts,
+        }
+        for key, val in [("TEMPERATURE", self.cfg.temperature), ("TOP_P", self.cfg.top_p),
+                         ("MAX_TOKENS", self.cfg.max_tokens)]:
+            if val is not None:
+                params[key] = f"{val:g}"
+        if self.prompts_file:
+            params["PROMPTS_FILE"] = str(self.prompts_file)
+        if self.cfg.request_timeout:
+            params["REQUEST_TIMEOUT"] = f"{self.scaled(self.cfg.request_timeout):g}"
+        if concurrency:
+            params["MAX_CONCURRENCY"] = concurrency
+        if labels:
+            params["LABELS"] = " ".join(labels)
+        if self.headers:
+            params["HEADERS"] = "\n".join(f"{k}={v}" for k, v in self.headers.items())
+        slos = slo_args(self.cfg.slo_ttft, self.cfg.slo_tpot)
+        if slos:
+            params["GOODPUT"] = slos
+        return params
+
+    def sample_rampup(self, labels):
+        """Record windowed generation throughput while the benchmark script runs."""
+        if not self.cfg.ramp_window or not self.generation_counter:
+            return contextlib.nullcontext()
+
+        def done(samples):
+            steady = time_to_steady_state(samples)
+            self.ramp_curves.append({"labels": list(labels), "samples": samples, "time_to_steady_s": steady})
+            if steady is None:
+                self.logger.warning(f"⚠ no throughput samples from {self.generation_counter}")
+            else:
+                self.logger.info(f"{self.name} reached steady-state throughput after {steady:g}s")
+        return sampling(sample_throughput, self.server_url(), self.generation_counter, self.headers,
+                        self.cfg.ramp_window, verify=self.verify_tls, done=done)
+
+    def own_results(self):
+        """The file this job's benchmark client writes; merged into results.json when the job ends."""
+        return self.root_dir / "benchmark-compare" / f"results-{self.name}.json"
+
+    def merge_results(self):
+        """Append this job's rows to the shared results.json and point results_path at it."""
+        own = self.own_results()
+        if self.results_path != own:
+            return
+        shared = own.with_name("results.json")
+        with RESULTS_REWRITE_LOCK:
+            try:
+                text = own.read_text()
+            except OSError:
+                return
+            if text and not text.endswith("\n"):
+                text += "\n"
+            with open(shared, "a") as f:
+                f.write(text)
+            own.unlink()
+        self.results_path = shared
+
+    def result_rows(self):
+        if self.results_path is None:
+            return []
+        try:
+            return [r for r in load_results(self.results_path) if self.owns(r)]
+        except (OSError, ValueError):
+            return []
+
+    def sample_energy(self, labels, interval_s=1):
+        """Integrate GPU power draw over the benchmark and relate it to the tokens generated."""
+        if not self.cfg.measure_energy:
+            return contextlib.nullcontext()
+        rows_before = len(self.result_rows())
+
+        def done(samples):
+            if len(samples) < 2:
+                self.logger.warning("⚠ no GPU power telemetry; energy not measured")
+                return
+            joules = integrate_energy([(t, sum(power.values())) for t, power in samples])
+            new_rows = self.result_rows()[rows_before:]
+            tokens = sum(r.get("total_output_tokens", 0) for r in new_rows) if new_rows else None
+            self.energy_runs.append({
+                "labels": list(labels), "joules": round(joules, 1), "wh": round(joules / 3600, 3),
+                "output_tokens": tokens,
+                "j_per_mtok": round(joules / tokens * 1e6, 1) if tokens else None,
+            })
+            self.logger.info(f"{self.name} benchmark used {joules / 3600:.2f} Wh of GPU energy")
+        return sampling(sample_gpus, query_gpu_power, self.cfg.cuda_device, interval_s, done=done)
+
+    def sample_gpu_memory(self, labels):
+        """Record the peak memory used on each of the job's GPUs while the benchmark runs."""
+        if not self.cfg.gpu_sample_interval:
+            return contextlib.nullcontext()
+
+        def done(samples):
+            if not samples:
+                self.logger.warning("⚠ no GPU memory readings; peak memory not recorded")
+                return
+            peak = {}
+            for _, used in samples:
+                for idx, mib in used.items():
+                    peak[idx] = max(peak.get(idx, 0), mib)
+            self.gpu_memory_runs.append({"labels": list(labels), "peak_mib": peak})
+            self.logger.info(f"{self.name} peak GPU memory {sum(peak.values())} MiB across {len(peak)} GPU(s)")
+        return sampling(sample_gpus, query_gpu_memory, self.cfg.cuda_device, self.cfg.gpu_sample_interval, done=done)
+
+    def run_benchmark(self, framework, labels, warmup=True, concurrency=None):
+        # all client-side settings are applied here so every framework sees the same workload
+        if warmup:
+            with self.phase("warmup"):
+                warmup_server(self.server_url(), self.served_model or self.model, self.logger,
+                              num_requests=self.cfg.warmup_requests, duration_s=self.cfg.warmup_duration,
+                              timeout_s=self.scaled(60), headers=self.headers, verify=self.verify_tls)
+        if warmup and self.cfg.debug_requests:
+            self.save_sample_request()
+        if self.cfg.compare_output_correctness and not self.correctness_outputs:
+            self.correctness_outputs = collect_outputs(self.server_url(), self.served_model or self.model,
+                                                       timeout_s=self.scaled(60), headers=self.headers,
+                                                       verify=self.verify_tls)
+        bench_dir = self.root_dir / "benchmark-compare"
+        bench_log = self.logs_dir / f"bench-{self.name}.log"
+        params = self.bench_params(labels, concurrency)
+        # header values are often gateway credentials: only their names are logged, emitted or compared
+        shown = dict(params)
+        if self.headers:
+            shown["HEADERS"] = "\n".join(f"{k}=***" for k in self.headers)
+        self.bench_runs.append(shown)
+        env_vars = f"FRAMEWORK={framework} " + "".join(
+            f"{k}={shlex.quote(str(v))} " for k, v in params.items())
+        shown_vars = f"FRAMEWORK={framework} " + "".join(
+            f"{k}={shlex.quote(str(v))} " for k, v in shown.items())
+        # where this job's server listens; like its served name, not part of the compared workload
+        server_vars = f"SCHEME={self.cfg.server_scheme} HOST={shlex.quote(self.cfg.server_host)} PORT={self.port} "
+        if self.served_model:
+            server_vars += f"SERVED_MODEL_NAME={shlex.quote(self.served_model)} "
+        # each job's client writes its own file, so concurrent jobs never rewrite each other's rows
+        server_vars += f"RESULT_FILENAME={shlex.quote(self.own_results().name)} "
+        env_vars += server_vars
+        shown_vars += server_vars
+        with open(bench_log, "a") as bf:
+            self.logger.info(f">>> Starting {self.name} benchmark; output → {bench_log.name}")
+            self.emit("benchmark_started", labels=labels, params=shown)
+            activate = f"source {self.cfg.bench_client_venv}/bin/activate && "
+            script = f"bash {shlex.quote('./' + self.cfg.bench_script)}"
+            bench_cmd = f"{activate}{env_vars}{script}"
+            self.logger.info(f"▶ {activate}{shown_vars}{script}")
+            ecc_before = self.ecc_counts()
+            with self.phase("benchmark"), self.sample_rampup(labels), self.sample_energy(labels), \
+                    self.sample_gpu_memory(labels):
+                try:
+                    run_cmd(["bash", "-c", bench_cmd], cwd=bench_dir, logfile=bf,
+                            echo=sys.stdout if self.cfg.verbose else None)
+                except subprocess.CalledProcessError as e:
+                    raise RuntimeError(f"benchmark script exited with code {e.returncode}; last lines of "
+                                       f"{bench_log}:\n{tail_file(bench_log)}") from None
+                if self.cfg.client == "vllm":
+                    own = self.own_results()
+                    # a script without RESULT_FILENAME support still appends to the shared file
+                    self.results_path = own if own.is_file() else find_results(bench_dir, framework)
+            self.logger.info(f"{self.name} benchmark script completed")
+            self.emit("benchmark_completed", labels=labels)
+            ecc_after = self.ecc_counts()
+            new_errors = {idx: n - ecc_before.get(idx, 0) for idx, n in ecc_after.items()
+                          if n > ecc_before.get(idx, 0)}
+            if new_errors:
+                self.ecc_suspect = True
+                self.logger.warning(f"⚠ new uncorrected ECC errors during the benchmark {new_errors}; "
+                                    f"{framework} results are suspect")
+        if self.results_path:
+            self.logger.info(f"{framework} results written to {self.results_path}")
+            summarize_failures(self.results_path, framework, self.logger, self.model)
+            self.record_results()
+
+    def record_results(self):
+        """Parse this job's results rows into bench_results and log each new run's headline."""
+        known = len(self.bench_results)
+        try:
+            self.bench_results = [benchmark_result(r) for r in self.result_rows()]
+        except ValueError as e:
+            self.logger.warning(f"⚠ unexpected benchmark output in {self.results_path}: {e}")
+            return
+        for res in self.bench_results[known:]:
+            self.logger.info(f"{res.framework} rate {res.request_rate}: {res.request_throughput:.2f} req/s, "
+                             f"{res.output_throughput:.0f} output tok/s, TTFT mean {res.mean_ttft_ms:.1f} / "
+                             f"p99 {res.p99_ttft_ms:.1f} ms, TPOT mean {res.mean_tpot_ms:.1f} ms")
+
+
+# low-level failures that usually succeed when the whole job is run again
+TRANSIENT_ERROR_RE = re.compile(
+    r"NCCL error|ncclSystemError|ncclUnhandledCudaError|ncclRemoteError|"
+    r"CUDA error: initialization error|cudaErrorInitializationError|CUDA driver initialization failed|"
+    r"CUDA error: (an )?unknown error|Address already in use")
+
+
+def is_transient_failure(job, err, tail_bytes=65536):
+    """Classify a job failure by its exception and the tail of the job's logs."""
+    if TRANSIENT_ERROR_RE.search(str(err)):
+        return True
+    for path in (job.logpath, job.logs_dir / f"bench-{job.name}.log"):
+        try:
+            with open(path, "rb") as f:
+                f.seek(max(path.stat().st_size - tail_bytes, 0))
+                if TRANSIENT_ERROR_RE.search(f.read().decode(errors="replace")):
+                    return True
+        except OSError:
+            continue
+    return False
+
+
+def run_job(job, logger, retries=0):
+    """Run one job, retrying transient failures; returns whether it succeeded."""
+    logger.info(f"▶ Running {job.name}")
+    emit_event("job_started", job=job.name, framework=job.framework)
+    # the budget covers retries too; thread-local so concurrent jobs time out independently
+    JOB_DEADLINE.at = time.time() + job.cfg.job_timeout if job.cfg.job_timeout else None
+    try:
+        for attempt in range(retries + 1):
+            try:
+                job.run()
+                logger.info(f"✓ {job.name} completed")
+                emit_event("job_completed", job=job.name, framework=job.framework)
+                return True
+            except Exception as e:
+                if attempt < retries and is_transient_failure(job, e):
+                    logger.warning(f"⚠ {job.name} failed with a transient error ({e}); "
+                                   f"retrying ({attempt + 1}/{retries})")
+                    emit_event("job_retrying", job=job.name, framework=job.framework, error=str(e),
+                               attempt=attempt + 1)
+                    job.reset_attempt()
+                    continue
+                job.timed_out = isinstance(e, DeadlineExceeded) and e.job_timeout
+                logger.error(f"✗ {job.name} {'timed out' if job.timed_out else 'failed'}: {e}")
+                emit_event("job_failed", job=job.name, framework=job.framework, error=str(e),
+                           failed_phase=job.failed_phase, timed_out=job.timed_out)
+                # a failed or timed-out job may still have its server up
+                kill_all_servers(logger, job.name)
+                return False
+            finally:
+                job.kill_process_groups()
+                job.reap()
+        return False
+    finally:
+        job.merge_results()
+        JOB_DEADLINE.at = None
+
+
+def run_jobs(jobs, logger, retries=0, concurrent=False):
+    if not concurrent:
+        # sequential runs stop at the first failure
+        for job in jobs:
+            if not run_job(job, logger, retries):
+                return
+        return
+    threads = [threading.Thread(target=run_job, args=(job, logger, retries), name=job.name, daemon=True)
+               for job in jobs]
+    for t in threads:
+        t.start()
+    for t in threads:
+        t.join()
+
+
+def assign_ports(jobs, cfg):
+    """Give every job its own port when jobs run concurrently or --ports lists them."""
+    if cfg.ports:
+        if len(cfg.ports) < len(jobs):
+            raise RuntimeError(f"--ports lists {len(cfg.ports)} port(s) for {len(jobs)} jobs")
+        ports = cfg.ports
+    elif cfg.run_async:
+        ports = [cfg.port + i for i in range(len(jobs))]
+    else:
+        return
+    for job, port in zip(jobs, ports):
+        job.port = port
 
 
 class VLLMJob(BaseJob):
-    def run(self):
-        self.logger.info("=== vllm benchmark start ===")
+    framework = "vllm"
+    gpu_mem_util_arg = "--gpu-memory-utilization"
+    max_num_seqs_arg = "--max-num-seqs"
+    tensor_parallel_arg = "--tensor-parallel-size"
+    version = VLLM_DEFAULT_VERSION
+    serve_pattern = "vllm serve"
+    import_module = "vllm"
+    ready_marker = r"Application startup complete|Uvicorn running on"
+    generation_counter = "vllm:generation_tokens_total"
 
-        # create venv & install vllm via uv
+    def install(self):
+        version = None if self.version == "nightly" else self.version
+        if self.cfg.keep_venvs and venv_has(self.root_dir / "venv-vllm", "vllm", version):
+            self.logger.info(f"Reusing venv-vllm with vllm {self.version}")
+            return "venv-vllm"
+        # create venv & install vllm via uv; a kept but incomplete venv starts over
+        shutil.rmtree(self.root_dir / "venv-vllm", ignore_errors=True)
         run_cmd(["uv", "venv", "venv-vllm", "--python", "3.12"],
                 cwd=self.root_dir, logfile=self.logfile, logger=self.logger)
-        run_cmd(["bash", "-c", "source venv-vllm/bin/activate && uv pip install vllm==0.8.3"],
+        if self.version == "nightly":
+            spec = f"-U vllm --pre --extra-index-url {VLLM_NIGHTLY_INDEX}"
+        else:
+            spec = shlex.quote(f"vllm=={self.version}")
+        run_cmd(["bash", "-c", f"source venv-vllm/bin/activate && uv pip install {spec}"],
                 cwd=self.root_dir, logfile=self.logfile, logger=self.logger)
         self.logger.info("vllm package installed in venv-vllm")
+        return "venv-vllm"
 
-        # launch vllm serve
-        env = os.environ.copy()
-        if self.cuda_dev:
-            env["CUDA_VISIBLE_DEVICES"] = self.cuda_dev
-        serve_cmd = ["vllm", "serve", self.model, "--disable-log-requests", "--port", str(self.port)]
-        self.logger.info(f"▶ source venv-vllm/bin/activate && {' '.join(serve_cmd)}")
-        proc = subprocess.Popen(
-            "bash -c 'source venv-vllm/bin/activate && " +
-            " ".join(serve_cmd) + "'", cwd=self.root_dir,
-            stdout=self.logfile, stderr=self.logfile,
-            env=env, preexec_fn=os.setsid, shell=True
-        )
-        self.logger.info(f"Started vllm serve (pid={proc.pid})")
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.version = cfg.vllm_version
+        self.extra_args = cfg.vllm_extra_args
+
+    def serve_cmd(self):
+        return ["vllm", "serve", self.model, "--disable-log-requests", "--port", str(self.port)]
+
+    def node_cmd(self, rank, server_args):
+        # workers join the head's ray cluster; the head spreads pipeline stages over every node
+        if rank:
+            return ["ray", "start", "--block", "--address", f"{self.cfg.nodes[0]}:{RAY_PORT}"]
+        return (["ray", "start", "--head", "--port", str(RAY_PORT), "&&"] + self.serve_cmd() + list(server_args)
+                + ["--pipeline-parallel-size", str(len(self.cfg.nodes)), "--distributed-executor-backend", "ray"])
+
+    def node_stop_cmd(self):
+        return "ray stop --force"
 
-        # wait for ready
-        self.logger.info("Waiting for vllm to load…")
-        wait_for_server("localhost", self.port, self.logger)
-        self.logger.info(f"vllm inference server ready at http://localhost:{self.port}/v1/models")
 
-        # 4) setup vllm-src & deps via uv with precompiled
+class VLLMCommitJob(VLLMJob):
+    """Serves vllm built from a specific commit of the source tree."""
+
+    def __init__(self, name, cfg, root_dir, logs_dir, model, commit):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.commit = commit
+        self.version = commit
+        self.framework = commit_label(commit)
+
+    def install(self):
         vllm_src = self.root_dir / "benchmark-compare" / "vllm"
-        self.logger.info(f"Creating venv-vllm-src in {vllm_src}")
-        run_cmd(["uv", "venv", "venv-vllm-src", "--python", "3.12"],
-                cwd=vllm_src, logfile=self.logfile, logger=self.logger)
-        deps_cmd = (
-            "source venv-vllm-src/bin/activate && "
-            "export VLLM_USE_PRECOMPILED=1 && "
-            "uv pip install -e . && "
-            "uv pip install numpy pandas datasets"
-        )
-        self.logger.info(f"▶ {deps_cmd}")
-        run_cmd(["bash", "-c", deps_cmd],
-                cwd=vllm_src, logfile=self.logfile, logger=self.logger)
-        self.logger.info("vllm-src dependencies installed (precompiled)")
+        worktree = self.root_dir / self.framework
+        shutil.rmtree(worktree, ignore_errors=True)
+        # forget the deleted worktree, or a retry or a second model's install cannot add it again
+        run_cmd(["git", "-C", str(vllm_src), "worktree", "prune"], logfile=self.logfile, logger=self.logger)
+        run_cmd(["git", "-C", str(vllm_src), "worktree", "add", "--detach", str(worktree), self.commit],
+                logfile=self.logfile, logger=self.logger)
+        build_source_venv(worktree, worktree / "venv-vllm-src", self.logfile, self.logger,
+                          precompiled=self.cfg.vllm_precompiled == "true")
+        self.logger.info(f"vllm installed from source at {self.commit}")
+        return f"{self.framework}/venv-vllm-src"
 
-        # run benchmark script
-        bench_dir = self.root_dir / "benchmark-compare"
-        bench_log = self.root_dir / "logs" / "bench-vllm.log"
-        with open(bench_log, "a") as bf:
-            self.logger.info(">>> Starting vllm benchmark; output → bench-vllm.log")
-            bench_cmd = (
-                "source vllm/venv-vllm-src/bin/activate && "
-                f"VLLM_USE_PRECOMPILED=1 MODEL={self.model} FRAMEWORK=vllm "
-                "bash ./benchmark_1000_in_100_out.sh"
-            )
-            self.logger.info(f"▶ {bench_cmd}")
-            subprocess.run(
-                ["bash", "-c", bench_cmd],
-                cwd=bench_dir, stdout=bf, stderr=bf, check=True
-            )
-            self.logger.info("vllm benchmark script completed")
 
-        # 6) tear down
-        self.logger.info(f"Stopping vllm server (pid={proc.pid})")
-        os.killpg(os.getpgid(proc.pid), signal.SIGKILL)
-        proc.wait()
-        self.logger.info("=== vllm benchmark done ===")
+DELTA_METRICS = ["request_throughput", "output_throughput", "median_ttft_ms", "median_tpot_ms"]
+
+
+def report_commit_delta(results_path, label_a, label_b, logger):
+    """Log per-request-rate metric deltas of label_b relative to label_a."""
+    try:
+        results = load_benchmark_results(results_path)
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        return
+    by_rate = {}
+    for res in results:
+        if res.framework in (label_a, label_b):
+            by_rate.setdefault(f"{res.request_rate}{res.tags}", {})[res.framework] = res
+
+    logger.info(f"=== {label_b} vs {label_a} ===")
+    logger.info(f"{'rate':<8} {'metric':<20} {label_a:>18} {label_b:>18} {'delta':>9}")
+    for rate, pair in by_rate.items():
+        if label_a not in pair or label_b not in pair:
+            continue
+        for key in DELTA_METRICS:
+            a, b = getattr(pair[label_a], key), getattr(pair[label_b], key)
+            if a is None or b is None:
+                continue
+            delta = (b - a) / a * 100 if a else 0.0
+            logger.info(f"{rate:<8} {key:<20} {a:>18.2f} {b:>18.2f} {delta:>+8.1f}%")
 
 
 class SGLangJob(BaseJob):
-    def run(self):
-        self.logger.info("=== sglang benchmark start ===")
+    framework = "sgl"
+    gpu_mem_util_arg = "--mem-fraction-static"
+    max_num_seqs_arg = "--max-running-requests"
+    tensor_parallel_arg = "--tp"
+    version = SGLANG_DEFAULT_VERSION
+    serve_pattern = "sglang.launch_server"
+    import_module = "sglang"
+    ready_marker = r"The server is fired up and ready to roll"
+    generation_counter = "sglang:generation_tokens_total"
 
-        # create venv & install sglang via uv
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.version = cfg.sglang_version
+        self.extra_args = cfg.sglang_extra_args
+
+    def install(self):
+        if self.cfg.keep_venvs and venv_has(self.root_dir / "venv-sgl", "sglang", self.version):
+            self.logger.info(f"Reusing venv-sgl with sglang {self.version}")
+            return "venv-sgl"
+        # create venv & install sglang via uv; a kept but incomplete venv starts over
+        shutil.rmtree(self.root_dir / "venv-sgl", ignore_errors=True)
         run_cmd(["uv", "venv", "venv-sgl", "--python", "3.12"],
                 cwd=self.root_dir, logfile=self.logfile, logger=self.logger)
         install_cmd = (
             "source venv-sgl/bin/activate && "
-            "uv pip install \"sglang[all]==0.4.4.post1\" "
-            "--find-links https://flashinfer.ai/whl/cu124/torch2.5/flashinfer-python"
+            f"uv pip install \"sglang[all]=={self.version}\" "
+            f"--find-links {self.cfg.flashinfer_index}"
         )
         self.logger.info(f"▶ {install_cmd}")
         run_cmd(["bash", "-c", install_cmd],
                 cwd=self.root_dir, logfile=self.logfile, logger=self.logger)
         self.logger.info("sglang package installed in venv-sgl")
+        return "venv-sgl"
 
-        # launch sglang serve
-        env = os.environ.copy()
-        if self.cuda_dev:
-            env["CUDA_VISIBLE_DEVICES"] = self.cuda_dev
-        serve_cmd = ["python3", "-m", "sglang.launch_server",
-                     "--model-path", self.model,
-                     "--host", "0.0.0.0", "--port", str(self.port)]
-        self.logger.info(f"▶ source venv-sgl/bin/activate && {' '.join(serve_cmd)}")
-        proc = subprocess.Popen(
-            "bash -c 'source venv-sgl/bin/activate && " +
-            " ".join(serve_cmd) + "'", cwd=self.root_dir,
-            stdout=self.logfile, stderr=self.logfile,
-            env=env, preexec_fn=os.setsid, shell=True
-        )
-        self.logger.info(f"Started sglang serve (pid={proc.pid})")
+    def serve_cmd(self):
+        cmd = ["python3", "-m", "sglang.launch_server",
+               "--model-path", self.model,
+               "--host", "0.0.0.0", "--port", str(self.port)]
+        if self.cfg.ramp_window:
+            # sglang only serves /metrics when asked to
+            cmd.append("--enable-metrics")
+        return cmd
 
-        # wait for ready
-        self.logger.info("Waiting for sglang to load…")
-        wait_for_server("localhost", self.port, self.logger)
-        self.logger.info(f"sglang inference server ready at http://localhost:{self.port}/v1/models")
+    def node_cmd(self, rank, server_args):
+        return self.serve_cmd() + list(server_args) + [
+            "--nnodes", str(len(self.cfg.nodes)), "--node-rank", str(rank),
+            "--dist-init-addr", f"{self.cfg.nodes[0]}:{DIST_INIT_PORT}"]
 
-        # 4) run benchmark script
-        bench_dir = self.root_dir / "benchmark-compare"
-        bench_log = self.root_dir / "logs" / "bench-sglang.log"
-        with open(bench_log, "a") as bf:
-            self.logger.info(">>> Starting sglang benchmark; output → bench-sglang.log")
-            bench_cmd = (
-                "source vllm/venv-vllm-src/bin/activate && "
-                f"VLLM_USE_PRECOMPILED=1 MODEL={self.model} FRAMEWORK=sgl "
-                "bash ./benchmark_1000_in_100_out.sh"
-            )
-            self.logger.info(f"▶ {bench_cmd}")
-            subprocess.run(
-                ["bash", "-c", bench_cmd],
-                cwd=bench_dir, stdout=bf, stderr=bf, check=True
-            )
-            self.logger.info("sglang benchmark script completed")
 
-        # tear down
-        self.logger.info(f"Stopping sglang server (pid={proc.pid})")
-        os.killpg(os.getpgid(proc.pid), signal.SIGKILL)
-        proc.wait()
-        self.logger.info("=== sglang benchmark done ===")
+class TGIJob(BaseJob):
+    """Serves with HuggingFace TGI: the local text-generation-launcher if installed, else its Docker image."""
+    framework = "tgi"
+    gpu_mem_util_arg = "--cuda-memory-fraction"
+    tensor_parallel_arg = "--num-shard"
+    version = TGI_DEFAULT_VERSION
+    serve_pattern = "text-generation-launcher"
+    health_path = "/health"
+
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.version = cfg.tgi_version
+        self.container = f"benchmark-{self.name}"
+        self.use_docker = shutil.which("text-generation-launcher") is None
+
+    def install(self):
+        if not self.use_docker:
+            out = subprocess.run(["text-generation-launcher", "--version"], capture_output=True, text=True)
+            self.version = out.stdout.strip().split()[-1] if out.returncode == 0 and out.stdout.strip() else "local"
+            self.logger.info(f"Using local text-generation-launcher {self.version}")
+            return None
+        if shutil.which("docker") is None:
+            raise RuntimeError("TGI needs text-generation-launcher or docker on PATH")
+        run_cmd(["docker", "pull", f"{TGI_IMAGE}:{self.version}"], logfile=self.logfile, logger=self.logger)
+        self.logger.info(f"TGI image {TGI_IMAGE}:{self.version} pulled")
+        return None
+
+    def serve_cmd(self):
+        args = ["--model-id", self.model, "--port", str(self.port)]
+        if not self.use_docker:
+            return ["text-generation-launcher"] + args
+        # the container sees every GPU; CUDA_VISIBLE_DEVICES narrows it like for the other frameworks
+        hf_cache = Path(os.getenv("HF_HOME", Path.home() / ".cache" / "huggingface")) / "hub"
+        cmd = ["docker", "run", "--rm", "--name", self.container, "--gpus", "all", "--shm-size", "1g",
+               "--network", "host", "-v", f"{hf_cache}:/data", "-e", "HF_TOKEN"]
+        if self.cfg.cuda_device:
+            cmd += ["-e", f"CUDA_VISIBLE_DEVICES={self.cfg.cuda_device}"]
+        return cmd + [f"{TGI_IMAGE}:{self.version}"] + args
+
+    def kill_server(self, proc):
+        super().kill_server(proc)
+        if self.use_docker:
+            # killing the docker client leaves the container running
+            subprocess.run(["docker", "rm", "-f", self.container], stdout=self.logfile,
+                           stderr=self.logfile, check=False)
+
+
+class LlamaCppJob(BaseJob):
+    """Serves a GGUF file with llama.cpp's llama-server: the one on PATH, else built from source."""
+    framework = "llamacpp"
+    max_num_seqs_arg = "--parallel"
+    version = LLAMACPP_DEFAULT_REF
+    serve_pattern = "llama-server"
+    install_attrs = ("version", "binary")
+    # 503 while the model loads, 200 once it can serve
+    health_path = "/health"
+
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.version = cfg.llamacpp_ref
+        self.gguf_model = Path(cfg.gguf_model).resolve()
+        self.binary = shutil.which("llama-server")
+
+    def install(self):
+        if self.binary:
+            self.version = "local"
+            self.logger.info(f"Using {self.binary}")
+            return None
+        src = self.root_dir / "llama.cpp"
+        shutil.rmtree(src, ignore_errors=True)
+        clone_repo(LLAMACPP_REPO, src, self.logger, ref=self.version, retries=self.cfg.clone_retries)
+        # CUDA offload when a GPU is present, otherwise a CPU build
+        cuda = "ON" if shutil.which("nvidia-smi") else "OFF"
+        run_cmd(["cmake", "-B", "build", f"-DGGML_CUDA={cuda}", "-DCMAKE_BUILD_TYPE=Release"],
+                cwd=src, logfile=self.logfile, logger=self.logger)
+        run_cmd(["cmake", "--build", "build", "--target", "llama-server", "-j", str(os.cpu_count() or 1)],
+                cwd=src, logfile=self.logfile, logger=self.logger)
+        self.binary = str(src / "build" / "bin" / "llama-server")
+        self.logger.info(f"llama-server {self.version} built at {self.binary}")
+        return None
+
+    def serve_cmd(self):
+        # the benchmark tokenizes with the HF model id; the server loads the matching GGUF.
+        # the command runs through bash, so the user-supplied paths are quoted
+        return [shlex.quote(self.binary), "-m", shlex.quote(str(self.gguf_model)), "--host", "0.0.0.0",
+                "--port", str(self.port), "--n-gpu-layers", "999"]
+
+
+class OllamaJob(BaseJob):
+    """Serves an Ollama tag with the ollama binary on PATH, benchmarked through its OpenAI-compatible API."""
+    framework = "ollama"
+    serve_pattern = "ollama serve"
+    # answers as soon as the server is up; the model is pulled afterwards
+    health_path = "/api/tags"
+
+    def __init__(self, name, cfg, root_dir, logs_dir, model):
+        super().__init__(name, cfg, root_dir, logs_dir, model)
+        self.served_model = cfg.ollama_model
+
+    def install(self):
+        if shutil.which("ollama") is None:
+            raise RuntimeError("the ollama framework needs the ollama binary on PATH")
+        out = subprocess.run(["ollama", "--version"], capture_output=True, text=True)
+        # e.g. "ollama version is 0.6.5", plus a warning when no server is running yet
+        self.version = out.stdout.strip().split()[-1] if out.returncode == 0 and out.stdout.strip() else "local"
+        self.logger.info(f"Using ollama {self.version}")
+        return None
+
+    def serve_cmd(self):
+        return [f"OLLAMA_HOST=0.0.0.0:{self.port}", "ollama", "serve"]
+
+    def after_ready(self):
+        run_cmd(["env", f"OLLAMA_HOST=127.0.0.1:{self.port}", "ollama", "pull", self.served_model],
+                logfile=self.logfile, logger=self.logger)
+        self.logger.info(f"ollama model {self.served_model} pulled")
+
+
+JOB_CLASSES = {
+    "vllm": VLLMJob,
+    "sglang": SGLangJob,
+    "tgi": TGIJob,
+    "llamacpp": LlamaCppJob,
+    "ollama": OllamaJob,
+}
+# jobs that run without --frameworks; TGI needs a local launcher or docker
+DEFAULT_FRAMEWORKS = ["vllm", "sglang"]
+
+
+def cleanup_framework(name, logs_dir, logger):
+    """Kill only the named framework's servers, preferring their recorded PID files."""
+    # <name>.pid, or <name>-<model>.pid per model when a run benchmarked several
+    stems = [name] + sorted(p.stem for p in logs_dir.glob(f"{glob.escape(name)}-*.pid"))
+    killed = [stem for stem in stems if kill_recorded_server(logs_dir, stem, logger)]
+    if killed:
+        return
+    job_cls = JOB_CLASSES.get(name)
+    if job_cls is None:
+        raise RuntimeError(f"no {pid_file(logs_dir, name).name} in {logs_dir} and {name!r} is not a known "
+                           f"framework ({', '.join(JOB_CLASSES)})")
+    logger.info(f"No PID file for {name}; killing processes matching {job_cls.serve_pattern!r}")
+    subprocess.run(["pkill", "-f", job_cls.serve_pattern], check=False)
+
+
+def cleanup_all(logs_dir, logger):
+    pid_files = sorted(logs_dir.glob("*.pid"))
+    if not pid_files:
+        logger.info(f"No server PID files in {logs_dir}")
+    for path in pid_files:
+        if not kill_recorded_server(logs_dir, path.stem, logger):
+            logger.warning(f"Ignoring unreadable PID file {path}")
+
+
+def slo_args(slo_ttft, slo_tpot):
+    parts = []
+    if slo_ttft:
+        parts.append(f"ttft:{slo_ttft:g}")
+    if slo_tpot:
+        parts.append(f"tpot:{slo_tpot:g}")
+    return " ".join(parts)
+
+
+def goodput(row, slo_ttft, slo_tpot):
+    """(fraction of all requests meeting the SLOs, such requests per second), or None without the data.
+
+    Failed requests (an error, or no output) never meet an SLO.
+    """
+    ttfts, itls, out_lens = row.get("ttfts"), row.get("itls"), row.get("output_lens")
+    errors, duration = row.get("errors") or [], row.get("duration")
+    if ttfts and itls and out_lens and duration:
+        good = 0
+        for i, (ttft, itl, n) in enumerate(zip(ttfts, itls, out_lens)):
+            if not n or (i < len(errors) and errors[i]):
+                continue
+            tpot = sum(itl) / (n - 1) if n > 1 else 0.0
+            if (not slo_ttft or ttft * 1000 <= slo_ttft) and (not slo_tpot or tpot * 1000 <= slo_tpot):
+                good += 1
+        return good / len(ttfts), good / duration
+    # the client's own goodput only counts completed requests already; older clients spell the key with a
+    # trailing colon
+    rate = row.get("request_goodput", row.get("request_goodput:"))
+    if rate is None or not duration:
+        return None
+    total = row.get("num_prompts") or row.get("completed")
+    return (rate * duration / total if total else None), rate
+
+
+def print_goodput(results_path, slo_ttft, slo_tpot, logger):
+    try:
+        rows = load_results(results_path)
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        return
+    logger.info(f"=== Goodput at SLO {slo_args(slo_ttft, slo_tpot)} (ms) ===")
+    logger.info(f"{'framework':<40} {'rate':>8} {'in SLO':>8} {'goodput req/s':>14}")
+    for r in rows:
+        measured = goodput(r, slo_ttft, slo_tpot)
+        if measured is None:
+            continue
+        frac, rate = measured
+        in_slo = f"{frac:>7.1%}" if frac is not None else "      -"
+        fw = r.get("framework", "?") + sweep_tags(r)
+        logger.info(f"{fw:<40} {r.get('request_rate')!s:>8} {in_slo} {rate:>14.2f}")
+
+
+def print_comparison(results_path, metric, logger, reference=None):
+    """Rank frameworks by metric averaged over every request rate they ran.
+
+    With a reference framework, each row also shows its delta against the
+    reference run with the same sweep settings.
+    """
+    try:
+        results = load_benchmark_results(results_path)
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        return
+    models = list(dict.fromkeys(res.model for res in results))
+    for model in models:
+        model_results = [res for res in results if res.model == model]
+        rank_frameworks(model_results, metric, logger, reference, model if len(models) > 1 else "")
+
+
+def rank_frameworks(results, metric, logger, reference=None, model=""):
+    key, unit, higher_better = COMPARE_METRICS[metric]
+    by_fw = {}
+    for res in results:
+        if getattr(res, key) is not None:
+            by_fw.setdefault((res.framework, res.tags), []).append(getattr(res, key))
+    if not by_fw:
+        logger.warning(f"No {key} values{' for ' + model if model else ''}")
+        return
+
+    means = {fw: sum(v) / len(v) for fw, v in by_fw.items()}
+    ranked = sorted(means.items(), key=lambda kv: kv[1], reverse=higher_better)
+    direction = "higher" if higher_better else "lower"
+    logger.info(f"=== Comparison by {metric} ({key}, {direction} is better){' for ' + model if model else ''} ===")
+    if reference:
+        logger.info(f"Reference framework: {reference}")
+    if not all(res.stream for res in results):
+        logger.info("Note: non-streaming runs report TTFT ≈ full request latency")
+    for (fw, tags), val in ranked:
+        ref_val = means.get((reference, tags))
+        delta = f"{(val - ref_val) / ref_val * 100:>+8.1f}%" if ref_val and fw != reference else ""
+        logger.info(f"{fw + tags:<40} {val:>12.2f} {unit:<6} {delta}")
+    winner, tags = ranked[0][0]
+    logger.info(f"🏆 Winner by {metric}: {winner}{tags}")
+
+
+def parse_results(path):
+    """Per framework and request rate throughput and latency from a results file.
+
+    Repeated runs of the same point (--repeat) are folded into one entry holding
+    the mean of each metric, its sample stddev as <metric>_stddev and the run count.
+    """
+    points = {}
+    for res in load_benchmark_results(path):
+        points.setdefault((res.framework + res.tags, res.request_rate), []).append(res)
+    results = []
+    for (framework, rate), runs in points.items():
+        entry = {"framework": framework, "results_label": runs[0].framework, "model": runs[0].model or None,
+                 "request_rate": rate, "runs": len(runs), **runs[0].settings}
+        for metric in SUMMARY_METRICS:
+            vals = [getattr(res, metric) for res in runs if getattr(res, metric) is not None]
+            entry[metric] = statistics.mean(vals) if vals else None
+            entry[metric + "_stddev"] = statistics.stdev(vals) if len(vals) > 1 else None
+        results.append(entry)
+    return results
+
+
+def print_results_table(results, out=sys.stdout):
+    def fmt(res, metric):
+        val, sd = res[metric], res.get(metric + "_stddev")
+        if not isinstance(val, (int, float)):
+            return "-"
+        return f"{val:.2f}±{sd:.2f}" if sd is not None else f"{val:.2f}"
+
+    out.write(f"{'framework':<40} {'rate':>8} {'req/s':>14} {'TTFT p50 ms':>16} {'TPOT p50 ms':>16}\n")
+    for res in results:
+        out.write(f"{res['framework']:<40} {res['request_rate']!s:>8} {fmt(res, 'request_throughput'):>14} "
+                  f"{fmt(res, 'median_ttft_ms'):>16} {fmt(res, 'median_tpot_ms'):>16}\n")
+    out.flush()
+
+
+def write_summary(results, path, cfg, sanity_violations=None):
+    """One machine-readable file with the run's config, cloned repo commits and every framework's metrics.
+
+    sanity_violations maps each job that failed --min-throughput or --max-ttft to what it violated.
+    """
+    config = dict(vars(cfg))
+    # header values and the token are credentials
+    config["headers"] = {name: "***" for name, _ in cfg.headers}
+    config["hf_token"] = "***" if cfg.hf_token else ""
+    summary = {
+        "timestamp": datetime.datetime.now(datetime.timezone.utc).isoformat(),
+        "config": config,
+        "repo_commits": cfg.repo_commits,
+        "gpus": cfg.gpu_info,
+        "frameworks": results,
+        "sanity_violations": sanity_violations or {},
+    }
+    write_atomic(path, json.dumps(summary, indent=2, default=str) + "\n")
+
+
+# only ever append to this list: spreadsheets and scripts address columns by header
+CSV_COLUMNS = ["framework", "model", "gpu_memory_utilization", "max_num_seqs", "max_concurrency", "request_rate",
+               "runs", "request_throughput", "request_throughput_stddev", "output_throughput",
+               "output_throughput_stddev", "median_ttft_ms", "median_ttft_ms_stddev", "p99_ttft_ms",
+               "p99_ttft_ms_stddev", "median_tpot_ms", "median_tpot_ms_stddev", "p99_tpot_ms",
+               "p99_tpot_ms_stddev", "p99_e2el_ms", "p99_e2el_ms_stddev"]
+
+
+def write_csv(results, path):
+    """Write parse_results entries as CSV; missing values are empty cells.
+
+    Numbers are written with Python's str(), which never depends on the locale.
+    """
+    with open(path, "w", newline="") as f:
+        writer = csv.writer(f)
+        writer.writerow(CSV_COLUMNS)
+        for res in results:
+            row = dict(res, framework=res["results_label"])
+            writer.writerow(["" if row.get(col) is None else row[col] for col in CSV_COLUMNS])
+
+
+def resolve_reference(jobs, wanted, logger):
+    """Pick the comparison baseline: the requested framework if it succeeded, else the first that did."""
+    succeeded = [j.framework for j in jobs if j.phases["teardown"] and not j.failed_phase]
+    if not succeeded:
+        return None
+    # accept a framework (sglang; job names add a model suffix with several models) or its results label (sgl)
+    wanted = {j.kind: j.framework for j in jobs}.get(wanted, wanted)
+    if not wanted or wanted in succeeded:
+        return wanted or succeeded[0]
+    logger.warning(f"⚠ Reference framework {wanted} failed or did not run; using {succeeded[0]} instead")
+    return succeeded[0]
+
+
+def sweep_label(job, labels):
+    """The job's results label followed by the sweep settings among a run's labels."""
+    tags = " ".join(label for label in labels if label.split("=", 1)[0] in SWEEP_KEYS)
+    return job.framework + (" " + tags if tags else "")
+
+
+def print_runs(jobs, attr, title, describe, logger):
+    """Log a table of every run the jobs recorded in attr: its sweep label, then describe(run)."""
+    runs = [(job, run) for job in jobs for run in getattr(job, attr)]
+    if not runs:
+        return
+    logger.info(f"=== {title} ===")
+    for job, run in runs:
+        logger.info(f"{sweep_label(job, run['labels']):<40} {describe(run)}")
+
+
+def print_rampup(jobs, logger):
+    def describe(curve):
+        steady = curve["time_to_steady_s"]
+        peak = max((tok_s for _, tok_s in curve["samples"]), default=0)
+        when = f"{steady:>7.1f}s" if steady is not None else "    n/a"
+        return f"{when}  (peak {peak:.0f} tok/s)"
+    print_runs(jobs, "ramp_curves", "Time to steady-state throughput", describe, logger)
+
+
+def print_energy(jobs, logger):
+    def describe(run):
+        per_mtok = f"{run['j_per_mtok']:>12.1f}" if run["j_per_mtok"] is not None else "         n/a"
+        return f"{per_mtok}  ({run['wh']:.2f} Wh)"
+    print_runs(jobs, "energy_runs", "GPU energy (J per million output tokens, lower is better)", describe, logger)
+
+
+def print_gpu_memory(jobs, logger):
+    def describe(run):
+        per_gpu = " ".join(f"gpu{idx}={mib}" for idx, mib in sorted(run["peak_mib"].items()))
+        return f"{sum(run['peak_mib'].values()):>8}  ({per_gpu})"
+    print_runs(jobs, "gpu_memory_runs", "Peak GPU memory (MiB)", describe, logger)
+
+
+def print_install_times(jobs, logger):
+    timed = [j for j in jobs if j.install_seconds is not None]
+    if not timed:
+        return
+    logger.info("=== Install times ===")
+    logger.info(f"{'framework':<20} {'version':<20} {'seconds':>10} {'import s':>10}")
+    for j in timed:
+        import_s = f"{j.import_seconds:.2f}" if j.import_seconds is not None else "-"
+        logger.info(f"{j.framework:<20} {j.version:<20} {j.install_seconds:>10.1f} {import_s:>10}")
+
+
+SUMMARY_METRICS = ["request_throughput", "output_throughput", "median_ttft_ms", "p99_ttft_ms",
+                   "median_tpot_ms", "p99_tpot_ms", "p99_e2el_ms"]
+
+
+def append_jsonl(path, results_path, cfg, logger):
+    """Append one line per framework variant so repeated runs build a time series."""
+    try:
+        results = load_benchmark_results(results_path)
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        return
+    timestamp = datetime.datetime.now(datetime.timezone.utc).isoformat()
+    runs = {}
+    for res in results:
+        key = (res.framework, res.variant, res.model or cfg.models[0])
+        runs.setdefault(key, []).append(
+            {"request_rate": res.request_rate, **{m: getattr(res, m) for m in SUMMARY_METRICS}})
+    lines = "".join(
+        json.dumps({"timestamp": timestamp, "framework": fw, "variant": variant, "model": model,
+                    "labels": dict(label.split("=", 1) for label in cfg.labels), "gpus": cfg.gpu_info,
+                    "metrics": metrics}) + "\n"
+        for (fw, variant, model), metrics in runs.items())
+
+    # one write under an exclusive lock keeps concurrent runs from interleaving lines
+    with open(path, "a") as f:
+        fcntl.flock(f, fcntl.LOCK_EX)
+        try:
+            f.write(lines)
+            f.flush()
+            os.fsync(f.fileno())
+        finally:
+            fcntl.flock(f, fcntl.LOCK_UN)
+    logger.info(f"Appended {len(runs)} run(s) to {path}")
+
+
+def workload_signature(rows):
+    """What the client actually sent, per run: identical seeds and lengths give identical tokens."""
+    return sorted((str(r.get("request_rate")), r.get("num_prompts"), r.get("max_concurrency"),
+                   r.get("total_input_tokens")) for r in rows)
+
+
+def check_parity(jobs, results_path):
+    """Compare the benchmark configuration each framework ran with, per model; returns divergences."""
+    divergences = []
+    for model in dict.fromkeys(j.model for j in jobs):
+        divergences += check_model_parity([j for j in jobs if j.model == model], results_path)
+    return divergences
+
+
+def check_model_parity(jobs, results_path):
+    ran = [j for j in jobs if j.bench_runs]
+    if len(ran) < 2:
+        return []
+    ref = ran[0]
+    divergences = []
+    for job in ran[1:]:
+        if job.bench_runs != ref.bench_runs:
+            divergences.append(f"{job.framework} client settings {job.bench_runs} differ from "
+                               f"{ref.framework} {ref.bench_runs}")
+    try:
+        rows = load_results(results_path)
+    except (OSError, ValueError):
+        return divergences
+    ref_sig = workload_signature(r for r in rows if ref.owns(r))
+    for job in ran[1:]:
+        sig = workload_signature(r for r in rows if job.owns(r))
+        if sig != ref_sig:
+            divergences.append(f"{job.framework} workload (rate, prompts, concurrency, input tokens) {sig} "
+                               f"differs from {ref.framework} {ref_sig}")
+    return divergences
+
+
+UNSAFE_PATH_RE = re.compile(r"[^A-Za-z0-9._-]+")
+
+
+def sanitize_model_name(model):
+    """Filesystem-safe single path component for a model id; results keep the original id.
+
+    "org/name" becomes "org--name", other unsafe characters become "_", and leading dots and
+    dashes are dropped so the name is never hidden, "..", or mistaken for an option. When that
+    mapping is not reversible (a "-" that would run into a separator, or any other change) a
+    short hash of the id is appended, so "a--b" and "a/b" never share a directory.
+    """
+    name = "--".join(UNSAFE_PATH_RE.sub("_", part) for part in model.strip().split("/") if part)
+    name = name.lstrip(".-") or "model"
+    parts = model.split("/")
+    if name != "--".join(parts) or any("--" in p or p.startswith("-") or p.endswith("-") for p in parts):
+        name += "-" + hashlib.sha256(model.encode()).hexdigest()[:8]
+    return name
+
+
+def split_by_model(results_path, logs_dir, results_root, model, logger, own_logs_only=False):
+    """Copy one model's results rows and this run's logs into results_root/<model-alias>/.
+
+    With own_logs_only, only logs whose name carries the model's alias are copied.
+    """
+    alias = sanitize_model_name(model)
+    out_dir = results_root / alias
+    (out_dir / "logs").mkdir(parents=True, exist_ok=True)
+    try:
+        rows = [r for r in load_results(results_path) if r.get("model_id", model) == model]
+    except (OSError, ValueError) as e:
+        logger.warning(f"Could not read {results_path}: {e}")
+        rows = []
+    # rewritten, not appended to, so running the split again does not duplicate rows
+    write_atomic(out_dir / "results.json", "".join(json.dumps(r) + "\n" for r in rows))
+    for path in logs_dir.iterdir():
+        if path.is_file() and (not own_logs_only or f"-{alias}" in path.name):
+            shutil.copy2(path, out_dir / "logs" / path.name)
+    logger.info(f"{len(rows)} {model} result(s) and logs written to {out_dir}")
+    return out_dir
+
+
+def combine_results(results_root, logger):
+    """Merge the per-model results files into one combined results.json-style file."""
+    combined = results_root / "combined.json"
+    rows = [r for path in sorted(results_root.glob("*/results.json")) for r in load_results(path)]
+    write_atomic(combined, "".join(json.dumps(r) + "\n" for r in rows))
+    logger.info(f"Combined {len(rows)} result(s) into {combined}")
+    return combined
+
+
+def print_status(jobs, logs_dir, logger, parity=()):
+    """Print a per-framework phase matrix and save it with the parity check to <logs>/status.json."""
+    logger.info("=== Phase status ===")
+    logger.info(f"{'framework':<20} " + " ".join(f"{p:>9}" for p in JOB_PHASES) + "  first failure")
+    for job in jobs:
+        marks = " ".join(f"{'✓' if job.phases[p] else '✗':>9}" for p in JOB_PHASES)
+        failed = job.failed_phase or ("-" if job.phases["teardown"] else "not run")
+        if job.timed_out:
+            failed += " (timed out)"
+        logger.info(f"{job.framework:<20} {marks}  {failed}")
+    status = {
+        "jobs": [job.status() for job in jobs],
+        "parity": {"ok": not parity, "divergences": list(parity)},
+    }
+    write_atomic(logs_dir / "status.json", json.dumps(status, indent=2) + "\n")
 
 
 def main():
     cfg = parse_args()
-    root = Path.cwd()
-    logs = root / "logs"
-    logs.mkdir(exist_ok=True)
-
     main_logger = logging.getLogger("main")
     main_logger.setLevel(logging.INFO)
-    main_logger.addHandler(logging.StreamHandler(sys.stdout))
+    main_logger.addHandler(log_handler(sys.stdout, cfg.log_format))
 
+    root = Path(cfg.work_dir).resolve() if cfg.work_dir else Path.cwd()
+    try:
+        root.mkdir(parents=True, exist_ok=True)
+        if not os.access(root, os.W_OK | os.X_OK):
+            raise PermissionError("not writable")
+    except OSError as e:
+        main_logger.error(f"✗ Cannot use work dir {root}: {e}")
+        sys.exit(1)
+    # an absolute --log-dir is used as is, a relative one lives under the work dir
+    logs = root / cfg.log_dir
+    logs.mkdir(parents=True, exist_ok=True)
+    if cfg.hf_token:
+        LOG_SECRETS.append(cfg.hf_token)
+        # servers, downloads and the benchmark client all inherit this environment
+        os.environ["HF_TOKEN"] = os.environ["HUGGING_FACE_HUB_TOKEN"] = cfg.hf_token
+
+    if cfg.cleanup:
+        cleanup_all(logs, main_logger)
+        return
+    if cfg.combine_results:
+        combine_results(root / "results", main_logger)
+        return
+    if cfg.cleanup_framework:
+        try:
+            cleanup_framework(cfg.cleanup_framework, logs, main_logger)
+        except RuntimeError as e:
+            main_logger.error(f"✗ {e}")
+            sys.exit(1)
+        return
+
+    install_signal_handlers(main_logger)
+    global RUN_DEADLINE, EVENT_STREAM
+    if cfg.timeout:
+        RUN_DEADLINE = time.time() + cfg.timeout
+    try:
+        if cfg.events:
+            EVENT_STREAM = sys.stdout if cfg.events == "-" else open(cfg.events, "a")
+    except OSError as e:
+        main_logger.error(f"✗ Cannot open event stream {cfg.events}: {e}")
+        sys.exit(1)
     main_logger.info(f"Using port: {cfg.port}")
-    global_setup(root, main_logger)
+    if cfg.insecure_skip_verify:
+        main_logger.warning("⚠ --insecure-skip-verify: this script does not check server TLS certificates; "
+                            f"the benchmark client checks them against {os.environ.get('SSL_CERT_FILE')}")
+        # one warning above instead of one per readiness poll
+        warnings.filterwarnings("ignore", message="Unverified HTTPS request")
+    # git, uv, pip, the Hub and the servers inherit these through the environment
+    if cfg.no_proxy_localhost == "true":
+        bypass_proxy_for_loopback(os.environ)
+    for var, val in proxy_settings(os.environ).items():
+        main_logger.info(f"{var}={val}")
+    if cfg.cuda_device:
+        main_logger.info(f"Using {cuda_device_count(cfg.cuda_device)} CUDA device(s): {cfg.cuda_device}")
+    if cfg.labels:
+        main_logger.info(f"Run labels: {' '.join(cfg.labels)}")
+    try:
+        check_gpu_free(cfg, main_logger)
+        check_gpu_ecc(cfg, main_logger)
+        if cfg.nodes:
+            check_nodes(cfg.nodes, main_logger)
+    except (RuntimeError, DeadlineExceeded) as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    try:
+        # async ports depend on the job count and are checked when each job launches
+        for port in cfg.ports or ([] if cfg.run_async else [cfg.port]):
+            check_port_available(port)
+    except RuntimeError as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    try:
+        # a misspelled or gated model should fail before minutes of clones and installs
+        preflight_models(cfg, main_logger)
+    except RuntimeError as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    try:
+        global_setup(root, cfg, main_logger)
+    except RuntimeError as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    check_tensor_parallel(cfg, main_logger)
+    apply_bench_defaults(cfg, load_bench_defaults(root / "benchmark-compare", main_logger))
+    cfg.bench_script = resolve_bench_script(root / "benchmark-compare", cfg, main_logger)
+    try:
+        check_bench_script(root / "benchmark-compare", cfg.bench_script)
+    except RuntimeError as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    if cfg.preload_weights:
+        for model in cfg.models:
+            preload_weights(root, model, main_logger)
+    main_logger.info(f"Benchmark settings: input_len={cfg.input_len} output_len={cfg.output_len} "
+                     f"num_prompts={cfg.num_prompts} script={cfg.bench_script}")
+    cfg.prompt_sets = {}
+    if cfg.freeze_prompts is not None:
+        try:
+            cfg.prompt_sets = {model: freeze_prompts(cfg, model, logs, main_logger) for model in cfg.models}
+        except RuntimeError as e:
+            main_logger.error(f"✗ {e}")
+            sys.exit(1)
+
+    if cfg.vllm_commit_a and cfg.vllm_precompiled == "true":
+        main_logger.warning("⚠ --vllm-precompiled true: both commits run the same precompiled kernels, so only "
+                            "their Python changes are compared; kernel regressions will not show")
+    if cfg.vllm_commit_a:
+        jobs = [VLLMCommitJob(name, cfg, root, logs, model, commit) for model in cfg.models
+                for name, commit in [("vllm-a", cfg.vllm_commit_a), ("vllm-b", cfg.vllm_commit_b)]]
+    else:
+        jobs = [JOB_CLASSES[name](name, cfg, root, logs, model) for model in cfg.models for name in cfg.frameworks]
+    try:
+        assign_ports(jobs, cfg)
+    except RuntimeError as e:
+        main_logger.error(f"✗ {e}")
+        sys.exit(1)
+    for job in jobs:
+        main_logger.info(f"{job.name} serves on port {job.port}")
+    run_jobs(jobs, main_logger, retries=cfg.job_retries, concurrent=cfg.run_async)
+    # like the phase matrix, a job that never reached teardown counts as not finished
+    emit_event("run_finished", failed=[job.name for job in jobs if job.failed_phase or not job.phases["teardown"]])
+
+    results_path = next((j.results_path for j in jobs if j.results_path), None)
+    if results_path is None:
+        try:
+            results_path = find_results(root / "benchmark-compare")
+        except FileNotFoundError as e:
+            main_logger.warning(f"⚠ {e}")
+            results_path = root / "benchmark-compare" / RESULTS_CANDIDATES[0]
+    parity = check_parity(jobs, results_path)
+    for d in parity:
+        main_logger.warning(f"⚠ BENCHMARK PARITY: {d}")
+    reference = resolve_reference(jobs, cfg.reference_framework, main_logger)
+    if cfg.compare_output_correctness:
+        check_output_correctness(jobs, reference, main_logger)
+    print_status(jobs, logs, main_logger, parity)
+    if cfg.client != "vllm":
+        main_logger.info(f"{cfg.client} reports are in benchmark-compare/{cfg.client}-*.json; "
+                         "the comparison below only covers results.json")
+    if cfg.vllm_commit_a:
+        report_commit_delta(results_path, jobs[0].framework, jobs[1].framework, main_logger)
+    try:
+        results = parse_results(results_path)
+    except (OSError, ValueError) as e:
+        main_logger.warning(f"⚠ Could not read {results_path} for the results table: {e}")
+        results = []
+    print_results_table(results)
+    write_summary(results, logs / "summary.json", cfg,
+                  {job.name: job.sanity_violations for job in jobs if job.sanity_violations})
+    main_logger.info(f"Run summary written to {logs / 'summary.json'}")
+    if cfg.csv_output:
+        write_csv(results, cfg.csv_output)
+        main_logger.info(f"Results CSV written to {cfg.csv_output}")
+    for d in validate_fairness([r for job in jobs for r in job.bench_results]):
+        main_logger.warning(f"⚠ SAMPLING MISMATCH: {d}")
+    print_comparison(results_path, cfg.compare_metric, main_logger, reference)
+    if cfg.slo_ttft or cfg.slo_tpot:
+        print_goodput(results_path, cfg.slo_ttft, cfg.slo_tpot, main_logger)
+    print_rampup(jobs, main_logger)
+    print_energy(jobs, main_logger)
+    print_gpu_memory(jobs, main_logger)
+    print_install_times(jobs, main_logger)
+    if cfg.append_jsonl:
+        append_jsonl(cfg.append_jsonl, results_path, cfg, main_logger)
+    zombies = defunct_children()
+    if zombies:
+        main_logger.warning(f"⚠ {len(zombies)} defunct child process(es) left after teardown: {zombies}")
+    for job in jobs:
+        for v in job.sanity_violations:
+            main_logger.warning(f"⚠ {job.name}: {v}")
 
-    jobs = [VLLMJob("vllm", cfg, root, logs),
-            SGLangJob("sglang", cfg, root, logs)]
-    run_jobs(jobs, main_logger)
+    if cfg.split_by_model:
+        for model in cfg.models:
+            split_by_model(results_path, logs, root / "results", model, main_logger,
+                           own_logs_only=len(cfg.models) > 1)
 
-    main_logger.info("✅ Benchmark results are in benchmark-compare/results.json")
+    main_logger.info(f"✅ Benchmark results are in {results_path}")
 
 
 if __name__ == "__main__":
@@ -1,11 +1,107 @@
 REQUEST_RATES=(1 10 20 30 35)
-INPUT_LEN=1000
-OUTPUT_LEN=100
+INPUT_LEN=${INPUT_LEN:-1000}
+OUTPUT_LEN=${OUTPUT_LEN:-100}
+# optional sampling parameters; MAX_TOKENS is sent as each request's output length
+TEMPERATURE=${TEMPERATURE:-}
+TOP_P=${TOP_P:-}
+MAX_TOKENS=${MAX_TOKENS:-}
+OUTPUT_LEN=${MAX_TOKENS:-$OUTPUT_LEN}
+SAMPLING_ARGS="${TEMPERATURE:+--temperature $TEMPERATURE} ${TOP_P:+--top-p $TOP_P}"
+SAMPLING_METADATA="${TEMPERATURE:+temperature=$TEMPERATURE} ${TOP_P:+top_p=$TOP_P} ${MAX_TOKENS:+max_tokens=$MAX_TOKENS}"
+INF_NUM_PROMPTS=${INF_NUM_PROMPTS:-2000}
 TOTAL_SECONDS=120
 HOST=${HOST:-127.0.0.1}
 PORT=${PORT:-8000}
+# http, or https for servers that terminate TLS
+SCHEME=${SCHEME:-http}
+BASE_URL_ARGS=""
+if [ "$SCHEME" != "http" ]; then
+    BASE_URL_ARGS="--base-url ${SCHEME}://${HOST}:${PORT}"
+fi
 MODEL=${MODEL:-meta-llama/Llama-3.1-8B-Instruct}
+# optional model name sent in requests when the server does not serve MODEL under its HF id (e.g. an Ollama tag)
+SERVED_MODEL_NAME=${SERVED_MODEL_NAME:-}
 FRAMEWORK=${FRAMEWORK:-vllm}
+# file the vllm client appends its rows to; concurrent runs each pass their own
+RESULT_FILENAME=${RESULT_FILENAME:-results.json}
+# load generator: vllm (benchmarks/benchmark_serving.py) or guidellm
+CLIENT=${CLIENT:-vllm}
+# true streams tokens back; false waits for whole responses (TTFT then equals full latency)
+STREAM=${STREAM:-true}
+STREAM_ARGS=""
+if [ "$STREAM" = "false" ]; then
+    STREAM_ARGS="--disable-stream"
+fi
+# optional per-request timeout (seconds) for the load generator
+REQUEST_TIMEOUT=${REQUEST_TIMEOUT:-}
+# optional cap on in-flight requests (vllm client only)
+MAX_CONCURRENCY=${MAX_CONCURRENCY:-}
+# optional space-separated key=value labels recorded alongside framework in results metadata
+LABELS=${LABELS:-}
+# optional newline-separated Name=Value HTTP headers sent with every request
+HEADERS=${HEADERS:-}
+HEADER_ARGS=()
+while IFS= read -r header; do
+    if [ -n "$header" ]; then
+        HEADER_ARGS+=(--header "$header")
+    fi
+done <<< "$HEADERS"
+# optional ShareGPT-format prompt file used instead of freshly generated random prompts
+PROMPTS_FILE=${PROMPTS_FILE:-}
+DATASET_ARGS="--dataset-name random --random-input-len $INPUT_LEN --random-output-len $OUTPUT_LEN"
+if [ -n "$PROMPTS_FILE" ]; then
+    DATASET_ARGS="--dataset-name sharegpt --dataset-path $PROMPTS_FILE --sharegpt-output-len $OUTPUT_LEN"
+fi
+# optional latency SLOs for goodput, e.g. "ttft:500 tpot:50" (milliseconds)
+GOODPUT=${GOODPUT:-}
+
+# run_client <request rate, empty for infinite> <num prompts> <seed>
+run_client() {
+    case "$CLIENT" in
+    vllm)
+        python3 vllm/benchmarks/benchmark_serving.py \
+            --model $MODEL \
+            ${SERVED_MODEL_NAME:+--served-model-name $SERVED_MODEL_NAME} \
+            $DATASET_ARGS \
+            ${1:+--request-rate $1} \
+            --num-prompts $2 \
+            --seed $3 \
+            --ignore-eos \
+            --percentile-metrics ttft,tpot,itl,e2el \
+            --result-filename "$RESULT_FILENAME" \
+            --metadata "framework=$FRAMEWORK" "stream=$STREAM" $SAMPLING_METADATA $LABELS \
+            --host ${HOST} \
+            --port ${PORT} \
+            $BASE_URL_ARGS \
+            $STREAM_ARGS \
+            $SAMPLING_ARGS \
+            "${HEADER_ARGS[@]}" \
+            ${REQUEST_TIMEOUT:+--request-timeout $REQUEST_TIMEOUT} \
+            ${MAX_CONCURRENCY:+--max-concurrency $MAX_CONCURRENCY} \
+            ${GOODPUT:+--goodput $GOODPUT} \
+            --save-result
+        ;;
+    guidellm)
+        local rate_args="--rate-type throughput"
+        if [ -n "$1" ]; then
+            rate_args="--rate-type constant --rate $1"
+        fi
+        guidellm benchmark \
+            --target "${SCHEME}://${HOST}:${PORT}" \
+            --model ${SERVED_MODEL_NAME:-$MODEL} \
+            ${SERVED_MODEL_NAME:+--processor $MODEL} \
+            --data "prompt_tokens=${INPUT_LEN},output_tokens=${OUTPUT_LEN}" \
+            $rate_args \
+            --max-requests $2 \
+            --random-seed $3 \
+            --output-path "guidellm-${FRAMEWORK}-${1:-inf}.json"
+        ;;
+    *)
+        echo "Unknown CLIENT=$CLIENT (expected vllm or guidellm)" >&2
+        exit 1
+        ;;
+    esac
+}
 
 for REQUEST_RATE in "${REQUEST_RATES[@]}";
 do
@@ -15,38 +111,13 @@ do
     echo "===== $FRAMEWORK - RUNNING $MODEL FOR $NUM_PROMPTS PROMPTS WITH $REQUEST_RATE QPS ====="
     echo ""
 
-    python3 vllm/benchmarks/benchmark_serving.py \
-        --model $MODEL \
-        --dataset-name random \
-        --random-input-len $INPUT_LEN \
-        --random-output-len $OUTPUT_LEN \
-        --request-rate $REQUEST_RATE \
-        --num-prompts $NUM_PROMPTS \
-        --seed $REQUEST_RATE \
-        --ignore-eos \
-        --result-filename "results.json" \
-        --metadata "framework=$FRAMEWORK" \
-        --host ${HOST} \
-        --port ${PORT} \
-        --save-result
+    run_client $REQUEST_RATE $NUM_PROMPTS $REQUEST_RATE
 
 done
 
 echo ""
-echo "===== RUNNING $MODEL FOR 2000 PROMPTS WITH infinite QPS ====="
+echo "===== RUNNING $MODEL FOR $INF_NUM_PROMPTS PROMPTS WITH infinite QPS ====="
 echo ""
 
 # inf request rate.pth
-python3 vllm/benchmarks/benchmark_serving.py \
-    --model $MODEL \
-    --dataset-name random \
-    --random-input-len $INPUT_LEN \
-    --random-output-len $OUTPUT_LEN \
-    --num-prompts 2000 \
-    --seed 42 \
-    --ignore-eos \
-    --result-filename "results.json" \
-    --metadata "framework=$FRAMEWORK" \
-    --host ${HOST} \
-    --port ${PORT} \
-    --save-result
+run_client "" $INF_NUM_PROMPTS 42